@@ -0,0 +1,29 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/qiniu/httpping/stream"
+)
+
+// NDJSONSink writes one StreamInfo per line as newline-delimited JSON,
+// the simplest sink: point it at os.Stdout for ad-hoc runs or at a file
+// tailed by a log shipper like Fluentd or Vector.
+type NDJSONSink struct {
+	enc *json.Encoder
+}
+
+// NewNDJSONSink returns a Sink that encodes each StreamInfo to w, one JSON
+// object per line.
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{enc: json.NewEncoder(w)}
+}
+
+func (s *NDJSONSink) Write(info *stream.StreamInfo) error {
+	return s.enc.Encode(info)
+}
+
+func (s *NDJSONSink) Close() error {
+	return nil
+}
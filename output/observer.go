@@ -0,0 +1,29 @@
+package output
+
+import (
+	"log"
+
+	"github.com/qiniu/httpping/stream"
+)
+
+// ObserverSink adapts a Sink to stream.Observer, writing a fresh snapshot
+// on every lifecycle event Prober.Observer delivers rather than only once
+// at the end of the probe. Any Sink (NDJSONSink, PrometheusSink, OtelSink)
+// can be wired in this way.
+type ObserverSink struct {
+	Sink Sink
+}
+
+func (o *ObserverSink) OnConnect(info *stream.StreamInfo)    { o.write(info) }
+func (o *ObserverSink) OnFirstVideo(info *stream.StreamInfo) { o.write(info) }
+func (o *ObserverSink) OnFirstAudio(info *stream.StreamInfo) { o.write(info) }
+func (o *ObserverSink) OnStall(info *stream.StreamInfo)      { o.write(info) }
+func (o *ObserverSink) OnResume(info *stream.StreamInfo)     { o.write(info) }
+func (o *ObserverSink) OnTick(info *stream.StreamInfo)       { o.write(info) }
+func (o *ObserverSink) OnEnd(info *stream.StreamInfo)        { o.write(info) }
+
+func (o *ObserverSink) write(info *stream.StreamInfo) {
+	if err := o.Sink.Write(info); err != nil {
+		log.Println("output: sink write error:", err)
+	}
+}
@@ -0,0 +1,96 @@
+package output
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/qiniu/httpping/stream"
+)
+
+// OtelSink records each probe's metrics as OpenTelemetry instruments
+// against the caller-supplied Meter, for setups that already ship metrics
+// through an OTel Collector rather than a Prometheus Pushgateway.
+type OtelSink struct {
+	ttfb       metric.Int64Histogram
+	startup    metric.Int64Histogram
+	stallCount metric.Int64Counter
+	stallMs    metric.Int64Counter
+	mos        metric.Float64Histogram
+	bitrate    metric.Int64Histogram
+
+	// StreamInfo's Stall* fields are cumulative for the whole probe, but
+	// Int64Counter.Add is itself additive, so Write must report only the
+	// delta since the last call or repeated OnTick events would multiply
+	// the exported total by however many times it's been written.
+	lastStallCount uint32
+	lastStallMs    uint32
+}
+
+// NewOtelSink creates the instruments OtelSink reports on, under meter.
+func NewOtelSink(meter metric.Meter) (*OtelSink, error) {
+	ttfb, err := meter.Int64Histogram("httpping.ttfb",
+		metric.WithUnit("ms"), metric.WithDescription("Time to first byte."))
+	if err != nil {
+		return nil, err
+	}
+
+	startup, err := meter.Int64Histogram("httpping.startup_delay",
+		metric.WithUnit("ms"), metric.WithDescription("Wall-clock from connect to the first rendered frame."))
+	if err != nil {
+		return nil, err
+	}
+
+	stallCount, err := meter.Int64Counter("httpping.stall_count",
+		metric.WithDescription("Steady-state rebuffer count."))
+	if err != nil {
+		return nil, err
+	}
+
+	stallMs, err := meter.Int64Counter("httpping.stall_duration",
+		metric.WithUnit("ms"), metric.WithDescription("Steady-state rebuffer duration."))
+	if err != nil {
+		return nil, err
+	}
+
+	mos, err := meter.Float64Histogram("httpping.mos",
+		metric.WithDescription("Estimated Mean Opinion Score, 1.0-5.0."))
+	if err != nil {
+		return nil, err
+	}
+
+	bitrate, err := meter.Int64Histogram("httpping.video_bitrate",
+		metric.WithUnit("kbps"), metric.WithDescription("Average video bitrate."))
+	if err != nil {
+		return nil, err
+	}
+
+	return &OtelSink{
+		ttfb:       ttfb,
+		startup:    startup,
+		stallCount: stallCount,
+		stallMs:    stallMs,
+		mos:        mos,
+		bitrate:    bitrate,
+	}, nil
+}
+
+func (s *OtelSink) Write(info *stream.StreamInfo) error {
+	ctx := context.Background()
+
+	s.ttfb.Record(ctx, int64(info.TtfbMs))
+	s.startup.Record(ctx, int64(info.StartupDelayMs))
+	s.stallCount.Add(ctx, int64(info.StallCountSteadyState-s.lastStallCount))
+	s.stallMs.Add(ctx, int64(info.StallDurationMsSteadyState-s.lastStallMs))
+	s.mos.Record(ctx, float64(info.MeanOpinionScore))
+	s.bitrate.Record(ctx, int64(info.AvgVideoBitrateKbps))
+
+	s.lastStallCount = info.StallCountSteadyState
+	s.lastStallMs = info.StallDurationMsSteadyState
+
+	return nil
+}
+
+func (s *OtelSink) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package output
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/qiniu/httpping/stream"
+)
+
+// OtelTracerSink emits one span per connection-setup phase (DNS, TCP
+// connect, TLS handshake, TTFB) plus one covering the wait for the first
+// video frame, using the wall-clock boundaries TcpWrapper already measured
+// into StreamInfo as the span timestamps rather than re-timing anything.
+// It only reacts to OnConnect and OnFirstVideo; the other Observer events
+// carry nothing a trace boundary would represent, so they're no-ops.
+type OtelTracerSink struct {
+	tracer trace.Tracer
+}
+
+// NewOtelTracerSink returns an Observer that traces connection setup and
+// startup latency through tracer.
+func NewOtelTracerSink(tracer trace.Tracer) *OtelTracerSink {
+	return &OtelTracerSink{tracer: tracer}
+}
+
+func (s *OtelTracerSink) OnConnect(info *stream.StreamInfo) {
+	ctx, ttfbSpan := s.tracer.Start(context.Background(), "httpping.ttfb",
+		trace.WithTimestamp(info.StartTime))
+	defer ttfbSpan.End(trace.WithTimestamp(info.StartTime.Add(time.Duration(info.TtfbMs) * time.Millisecond)))
+
+	cursor := info.StartTime
+	cursor = s.phaseSpan(ctx, "httpping.dns", cursor, info.DnsTimeMs)
+	cursor = s.phaseSpan(ctx, "httpping.tcp_connect", cursor, info.TcpConnectTimeMs)
+	if info.TLSHandshakeTimeMs > 0 {
+		s.phaseSpan(ctx, "httpping.tls_handshake", cursor, info.TLSHandshakeTimeMs)
+	}
+}
+
+func (s *OtelTracerSink) OnFirstVideo(info *stream.StreamInfo) {
+	_, span := s.tracer.Start(context.Background(), "httpping.first_video",
+		trace.WithTimestamp(info.StartTime))
+	span.End(trace.WithTimestamp(info.StartTime.Add(time.Duration(info.FirstVideoPktTimeMs) * time.Millisecond)))
+}
+
+func (s *OtelTracerSink) OnFirstAudio(info *stream.StreamInfo) {}
+func (s *OtelTracerSink) OnStall(info *stream.StreamInfo)      {}
+func (s *OtelTracerSink) OnResume(info *stream.StreamInfo)     {}
+func (s *OtelTracerSink) OnTick(info *stream.StreamInfo)       {}
+func (s *OtelTracerSink) OnEnd(info *stream.StreamInfo)        {}
+
+// phaseSpan records a child span covering [start, start+durationMs] and
+// returns its end time, so callers can chain phases one after another.
+func (s *OtelTracerSink) phaseSpan(ctx context.Context, name string, start time.Time, durationMs uint32) time.Time {
+	end := start.Add(time.Duration(durationMs) * time.Millisecond)
+
+	_, span := s.tracer.Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+
+	return end
+}
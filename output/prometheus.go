@@ -0,0 +1,58 @@
+package output
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/qiniu/httpping/stream"
+)
+
+// PrometheusSink pushes each probe's metrics to a Prometheus Pushgateway.
+// httpping runs one probe per invocation and exits, so there's no process
+// around long enough to be scraped; pushing is the usual pattern for
+// short-lived jobs like this one (the same approach blackbox_exporter
+// recommends for cron-triggered checks).
+type PrometheusSink struct {
+	pusher *push.Pusher
+
+	ttfb       prometheus.Gauge
+	startup    prometheus.Gauge
+	stallCount prometheus.Gauge
+	stallMs    prometheus.Gauge
+	mos        prometheus.Gauge
+	bitrate    prometheus.Gauge
+}
+
+// NewPrometheusSink returns a Sink that pushes to gatewayURL under the
+// given job/instance labels each time Write is called.
+func NewPrometheusSink(gatewayURL, job, instance string) *PrometheusSink {
+	s := &PrometheusSink{
+		ttfb:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_ttfb_ms", Help: "Time to first byte, in milliseconds."}),
+		startup:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_startup_delay_ms", Help: "Wall-clock from connect to the first rendered frame, in milliseconds."}),
+		stallCount: prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_stall_count", Help: "Steady-state rebuffer count."}),
+		stallMs:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_stall_duration_ms", Help: "Total steady-state rebuffer duration, in milliseconds."}),
+		mos:        prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_mos", Help: "Estimated Mean Opinion Score, 1.0-5.0."}),
+		bitrate:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "httpping_video_bitrate_kbps", Help: "Average video bitrate, in kbps."}),
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s.ttfb, s.startup, s.stallCount, s.stallMs, s.mos, s.bitrate)
+	s.pusher = push.New(gatewayURL, job).Grouping("instance", instance).Gatherer(reg)
+
+	return s
+}
+
+func (s *PrometheusSink) Write(info *stream.StreamInfo) error {
+	s.ttfb.Set(float64(info.TtfbMs))
+	s.startup.Set(float64(info.StartupDelayMs))
+	s.stallCount.Set(float64(info.StallCountSteadyState))
+	s.stallMs.Set(float64(info.StallDurationMsSteadyState))
+	s.mos.Set(float64(info.MeanOpinionScore))
+	s.bitrate.Set(float64(info.AvgVideoBitrateKbps))
+
+	return s.pusher.Push()
+}
+
+func (s *PrometheusSink) Close() error {
+	return nil
+}
@@ -0,0 +1,18 @@
+// Package output reports a probe's stream.StreamInfo to whatever system
+// operates on it downstream, behind a single Sink interface so httpping
+// can be pointed at a log pipeline, a Prometheus Pushgateway, or an
+// OpenTelemetry collector without touching the probe itself. Wrapping a
+// Sink in an ObserverSink (see observer.go) and wiring it into
+// Prober.Observer turns that one-shot report into a stream of snapshots
+// pushed out as the probe runs.
+package output
+
+import "github.com/qiniu/httpping/stream"
+
+// Sink consumes a StreamInfo snapshot. Close is called once when the
+// caller is done emitting, giving a sink the chance to flush or tear down
+// a connection.
+type Sink interface {
+	Write(info *stream.StreamInfo) error
+	Close() error
+}
@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Minimal AMF0 (Action Message Format) codec, just enough to build the
+// connect/createStream/play command chain and read back onMetaData/_result.
+// See the "Action Message Format -- AMF 0" spec.
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0EcmaArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+)
+
+var ErrInvaildAmf0 = errors.New("invalid amf0 value")
+
+type amf0Pair struct {
+	key   string
+	value interface{}
+}
+
+func encodeAmf0(v interface{}) []byte {
+	switch val := v.(type) {
+	case float64:
+		buf := make([]byte, 9)
+		buf[0] = amf0Number
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(val))
+		return buf
+
+	case bool:
+		b := byte(0)
+		if val {
+			b = 1
+		}
+		return []byte{amf0Boolean, b}
+
+	case string:
+		buf := make([]byte, 3+len(val))
+		buf[0] = amf0String
+		binary.BigEndian.PutUint16(buf[1:3], uint16(len(val)))
+		copy(buf[3:], val)
+		return buf
+
+	case []amf0Pair:
+		buf := []byte{amf0Object}
+		for _, pair := range val {
+			buf = append(buf, encodeAmf0Key(pair.key)...)
+			buf = append(buf, encodeAmf0(pair.value)...)
+		}
+		buf = append(buf, 0x00, 0x00, amf0ObjectEnd)
+		return buf
+
+	case nil:
+		return []byte{amf0Null}
+	}
+
+	return []byte{amf0Null}
+}
+
+func encodeAmf0Key(key string) []byte {
+	buf := make([]byte, 2+len(key))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(key)))
+	copy(buf[2:], key)
+	return buf
+}
+
+// decodeAmf0 decodes a single AMF0 value and returns the remaining bytes.
+func decodeAmf0(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, data, ErrInvaildAmf0
+	}
+
+	switch data[0] {
+	case amf0Number:
+		if len(data) < 9 {
+			return nil, data, ErrInvaildAmf0
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), data[9:], nil
+
+	case amf0Boolean:
+		if len(data) < 2 {
+			return nil, data, ErrInvaildAmf0
+		}
+		return data[1] != 0, data[2:], nil
+
+	case amf0String:
+		return decodeAmf0String(data[1:])
+
+	case amf0Null:
+		return nil, data[1:], nil
+
+	case amf0Object:
+		return decodeAmf0Object(data[1:])
+
+	case amf0EcmaArray:
+		if len(data) < 5 {
+			return nil, data, ErrInvaildAmf0
+		}
+		return decodeAmf0Object(data[5:]) // skip the 4-byte associative-count
+
+	default:
+		return nil, data, ErrInvaildAmf0
+	}
+}
+
+func decodeAmf0String(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", data, ErrInvaildAmf0
+	}
+
+	n := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+n {
+		return "", data, ErrInvaildAmf0
+	}
+
+	return string(data[2 : 2+n]), data[2+n:], nil
+}
+
+func decodeAmf0Object(data []byte) (map[string]interface{}, []byte, error) {
+	obj := make(map[string]interface{})
+
+	for {
+		if len(data) >= 3 && data[0] == 0x00 && data[1] == 0x00 && data[2] == amf0ObjectEnd {
+			return obj, data[3:], nil
+		}
+
+		key, rest, err := decodeAmf0String(data)
+		if err != nil {
+			return obj, data, err
+		}
+
+		val, rest2, err := decodeAmf0(rest)
+		if err != nil {
+			return obj, data, err
+		}
+
+		obj[key] = val
+		data = rest2
+	}
+}
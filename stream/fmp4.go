@@ -0,0 +1,403 @@
+package stream
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// detectContainer figures out whether a segment is legacy MPEG-TS or
+// fragmented MP4 (fMP4/CMAF). A segment referenced via #EXT-X-MAP is always
+// fMP4; otherwise fall back to sniffing the leading box of the segment
+// itself (ftyp/styp/moof), which covers playlists that omit EXT-X-MAP but
+// still serve .m4s media.
+func detectContainer(initUrl string, data []byte) uint32 {
+	if initUrl != "" {
+		return ContainerFMP4
+	}
+
+	if len(data) >= 8 {
+		switch string(data[4:8]) {
+		case "ftyp", "styp", "moof":
+			return ContainerFMP4
+		}
+	}
+
+	return ContainerTS
+}
+
+// findBoxes returns the bodies (payload, header stripped) of every
+// top-level box of the given type found in data. It only understands the
+// common 32-bit size form; a 64-bit largesize (size == 1) box stops the
+// walk since it cannot appear in the small boxes this package cares about.
+func findBoxes(data []byte, boxType string) [][]byte {
+	var boxes [][]byte
+
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data[0:4])
+		typ := string(data[4:8])
+
+		if size < 8 || int(size) > len(data) {
+			break
+		}
+
+		if typ == boxType {
+			boxes = append(boxes, data[8:size])
+		}
+
+		data = data[size:]
+	}
+
+	return boxes
+}
+
+func findBox(data []byte, boxType string) []byte {
+	boxes := findBoxes(data, boxType)
+	if len(boxes) == 0 {
+		return nil
+	}
+
+	return boxes[0]
+}
+
+// parseTrackTypes walks the init segment's moov box and returns, for each
+// track, whether it carries PktVideo or PktAudio, keyed by track ID. trun
+// samples in later moof boxes only carry a track ID, so this is needed to
+// tell audio and video fragments apart.
+func parseTrackTypes(init []byte) map[uint32]uint32 {
+	tracks := make(map[uint32]uint32)
+
+	for _, t := range parseTrackInfos(init) {
+		tracks[t.TrackID] = t.Type
+	}
+
+	return tracks
+}
+
+// parseTrackTimescales walks the init segment's moov box and returns each
+// track's mdhd timescale (ticks per second), keyed by track ID. trun sample
+// durations and tfdt's baseMediaDecodeTime are both in this timescale, so
+// it's needed to normalize pts to milliseconds.
+func parseTrackTimescales(init []byte) map[uint32]uint32 {
+	timescales := make(map[uint32]uint32)
+
+	moov := findBox(init, "moov")
+	if moov == nil {
+		return timescales
+	}
+
+	for _, trak := range findBoxes(moov, "trak") {
+		trackId, ok := parseTrackId(findBox(trak, "tkhd"))
+		if !ok {
+			continue
+		}
+
+		mdia := findBox(trak, "mdia")
+		if mdia == nil {
+			continue
+		}
+
+		if ts, ok := parseMdhdTimescale(findBox(mdia, "mdhd")); ok {
+			timescales[trackId] = ts
+		}
+	}
+
+	return timescales
+}
+
+// parseMdhdTimescale reads the timescale field out of an mdhd box, which
+// sits right after the (version-dependent width) creation/modification
+// times.
+func parseMdhdTimescale(mdhd []byte) (uint32, bool) {
+	if len(mdhd) < 1 {
+		return 0, false
+	}
+
+	pos := 4 // version(1)+flags(3)
+	if mdhd[0] == 1 {
+		pos += 16 // creation_time(8)+modification_time(8), 64-bit form
+	} else {
+		pos += 8 // creation_time(4)+modification_time(4), 32-bit form
+	}
+
+	if len(mdhd) < pos+4 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(mdhd[pos : pos+4]), true
+}
+
+// parseTrackInfos walks the init segment's moov box and returns one
+// TrackInfo per trak, with codec/sample-rate/channels/width/height pulled
+// from the track's stsd sample entry.
+func parseTrackInfos(init []byte) []TrackInfo {
+	var infos []TrackInfo
+
+	moov := findBox(init, "moov")
+	if moov == nil {
+		return infos
+	}
+
+	for _, trak := range findBoxes(moov, "trak") {
+		trackId, ok := parseTrackId(findBox(trak, "tkhd"))
+		if !ok {
+			continue
+		}
+
+		mdia := findBox(trak, "mdia")
+		if mdia == nil {
+			continue
+		}
+
+		hdlr := findBox(mdia, "hdlr")
+		if len(hdlr) < 12 {
+			continue
+		}
+
+		var pktType uint32
+		switch string(hdlr[8:12]) {
+		case "vide":
+			pktType = PktVideo
+		case "soun":
+			pktType = PktAudio
+		default:
+			continue
+		}
+
+		info := TrackInfo{TrackID: trackId, Type: pktType}
+
+		minf := findBox(mdia, "minf")
+		stbl := findBox(minf, "stbl")
+		stsd := findBox(stbl, "stsd")
+		parseSampleEntry(stsd, &info)
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// parseSampleEntry reads the first entry of a stsd box: its 4-char format
+// (the codec fourCC, e.g. avc1/hvc1/av01/mp4a/Opus/ac-3) plus, depending on
+// track type, the video width/height or audio sample rate/channel count.
+func parseSampleEntry(stsd []byte, info *TrackInfo) {
+	if len(stsd) < 16 {
+		return
+	}
+
+	entry := stsd[8:] // skip version+flags(4) and entry_count(4)
+	if len(entry) < 16 {
+		return
+	}
+
+	info.Codec = strings.TrimRight(string(entry[4:8]), "\x00")
+
+	body := entry[16:] // skip size(4)+format(4)+reserved(6)+data_reference_index(2)
+
+	if info.Type == PktVideo {
+		if len(body) >= 32 {
+			// pre_defined(2)+reserved(2)+pre_defined(12), then width(2)+height(2)
+			info.Width = uint32(binary.BigEndian.Uint16(body[16:18]))
+			info.Height = uint32(binary.BigEndian.Uint16(body[18:20]))
+		}
+		return
+	}
+
+	if len(body) >= 20 {
+		info.Channels = uint32(binary.BigEndian.Uint16(body[8:10]))
+		info.SampleRate = uint32(binary.BigEndian.Uint16(body[16:18])) // drop the 16.16 fixed-point fraction
+	}
+}
+
+func parseTrackId(tkhd []byte) (uint32, bool) {
+	if len(tkhd) < 16 {
+		return 0, false
+	}
+
+	if tkhd[0] == 1 {
+		if len(tkhd) < 24 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(tkhd[20:24]), true
+	}
+
+	return binary.BigEndian.Uint32(tkhd[12:16]), true
+}
+
+// demuxFmp4 is the fMP4/CMAF counterpart of demux(): it parses the moof of
+// the segment held in c.buffer into a queue of samples and pops one per
+// call, mirroring how demux() walks TS packets one at a time.
+func (c *HlsClient) demuxFmp4() (*AVPacket, error) {
+	if len(c.samples) == 0 {
+		c.samples = c.parseMoof(c.buffer)
+		c.buffer = nil
+	}
+
+	if len(c.samples) == 0 {
+		return nil, ErrTryAgain
+	}
+
+	pkt := c.samples[0]
+	c.samples = c.samples[1:]
+	return &pkt, nil
+}
+
+// sampleNonSyncFlag is the sample_is_non_sync_sample bit of an ISOBMFF
+// sample_flags field (ISO/IEC 14496-12 8.8.3.1): clear means the sample is
+// a sync sample (keyframe).
+const sampleNonSyncFlag = 0x00010000
+
+// parseMoof extracts one AVPacket per sample referenced by the first trun
+// box of each traf box in data's first moof; further trun boxes in the same
+// traf are not read. Samples are emitted in decode order with
+// pts derived from tfdt's baseMediaDecodeTime plus accumulated sample
+// durations, normalized from the track's mdhd timescale to milliseconds.
+func (c *HlsClient) parseMoof(data []byte) []AVPacket {
+	var pkts []AVPacket
+
+	moof := findBox(data, "moof")
+	if moof == nil {
+		return pkts
+	}
+
+	for _, traf := range findBoxes(moof, "traf") {
+		tfhd := findBox(traf, "tfhd")
+		if len(tfhd) < 8 {
+			continue
+		}
+
+		trackId := binary.BigEndian.Uint32(tfhd[4:8])
+		pktType, known := c.trackTypes[trackId]
+		if !known {
+			continue
+		}
+
+		timescale := c.trackTimescales[trackId]
+		if timescale == 0 {
+			timescale = 1000 // assume already-millisecond ticks if mdhd wasn't parsed
+		}
+
+		tfhdFlags := binary.BigEndian.Uint32(tfhd[0:4]) & 0x00ffffff
+		pos := 8
+
+		if tfhdFlags&0x000001 != 0 { // base-data-offset-present
+			pos += 8
+		}
+		if tfhdFlags&0x000002 != 0 { // sample-description-index-present
+			pos += 4
+		}
+
+		var defaultSampleDuration uint32
+		if tfhdFlags&0x000008 != 0 { // default-sample-duration-present
+			if len(tfhd) < pos+4 {
+				continue
+			}
+			defaultSampleDuration = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+			pos += 4
+		}
+		if tfhdFlags&0x000010 != 0 { // default-sample-size-present
+			pos += 4
+		}
+
+		var defaultSampleFlags uint32
+		haveDefaultFlags := tfhdFlags&0x000020 != 0 // default-sample-flags-present
+		if haveDefaultFlags {
+			if len(tfhd) < pos+4 {
+				continue
+			}
+			defaultSampleFlags = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+		}
+
+		var decodeTime uint64
+		if tfdt := findBox(traf, "tfdt"); len(tfdt) >= 8 {
+			if tfdt[0] == 1 && len(tfdt) >= 12 {
+				decodeTime = binary.BigEndian.Uint64(tfdt[4:12])
+			} else {
+				decodeTime = uint64(binary.BigEndian.Uint32(tfdt[4:8]))
+			}
+		}
+
+		pkts = append(pkts, c.parseTrun(findBox(traf, "trun"), trackId, pktType, defaultSampleDuration, defaultSampleFlags, haveDefaultFlags, decodeTime, timescale)...)
+	}
+
+	return pkts
+}
+
+func (c *HlsClient) parseTrun(trun []byte, trackId uint32, pktType uint32, defaultSampleDuration uint32, defaultSampleFlags uint32, haveDefaultFlags bool, decodeTime uint64, timescale uint32) []AVPacket {
+	if len(trun) < 8 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint32(trun[0:4]) & 0x00ffffff
+	sampleCount := binary.BigEndian.Uint32(trun[4:8])
+	pos := 8
+
+	if flags&0x000001 != 0 { // data-offset-present
+		pos += 4
+	}
+
+	var firstSampleFlags uint32
+	haveFirstSampleFlags := flags&0x000004 != 0 // first-sample-flags-present
+	if haveFirstSampleFlags {
+		if len(trun) < pos+4 {
+			return nil
+		}
+		firstSampleFlags = binary.BigEndian.Uint32(trun[pos : pos+4])
+		pos += 4
+	}
+
+	var pkts []AVPacket
+	for i := uint32(0); i < sampleCount; i++ {
+		duration := defaultSampleDuration
+		sampleFlags := defaultSampleFlags
+		haveSampleFlags := haveDefaultFlags
+
+		if flags&0x000100 != 0 { // sample-duration-present
+			if len(trun) < pos+4 {
+				break
+			}
+			duration = binary.BigEndian.Uint32(trun[pos : pos+4])
+			pos += 4
+		}
+		if flags&0x000200 != 0 { // sample-size-present
+			pos += 4
+		}
+		if flags&0x000400 != 0 { // sample-flags-present
+			if len(trun) < pos+4 {
+				break
+			}
+			sampleFlags = binary.BigEndian.Uint32(trun[pos : pos+4])
+			haveSampleFlags = true
+			pos += 4
+		} else if i == 0 && haveFirstSampleFlags {
+			sampleFlags = firstSampleFlags
+			haveSampleFlags = true
+		}
+		if flags&0x000800 != 0 { // sample-composition-time-offsets-present
+			pos += 4
+		}
+
+		// Fall back to "first sample in the fragment is the keyframe" only
+		// when the fragment carries no flags at all to say otherwise; a
+		// CMAF encoder that sets default-sample-flags/sample-flags is
+		// trusted over that heuristic.
+		keyframe := pktType == PktVideo
+		if keyframe {
+			if haveSampleFlags {
+				keyframe = sampleFlags&sampleNonSyncFlag == 0
+			} else {
+				keyframe = i == 0
+			}
+		}
+
+		pkts = append(pkts, AVPacket{
+			pktType:  pktType,
+			pts:      uint32(decodeTime * 1000 / uint64(timescale)),
+			keyframe: keyframe,
+			trackId:  trackId,
+		})
+
+		decodeTime += uint64(duration)
+	}
+
+	return pkts
+}
@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// buildTrun assembles a trun box body with sample-duration-present and
+// sample-flags-present set (no data-offset, no first-sample-flags), one
+// duration+flags pair per sample.
+func buildTrun(durations []uint32, flags []uint32) []byte {
+	const trunFlags = 0x000100 | 0x000400 // sample-duration + sample-flags present
+
+	trun := make([]byte, 8)
+	binary.BigEndian.PutUint32(trun[0:4], trunFlags)
+	binary.BigEndian.PutUint32(trun[4:8], uint32(len(durations)))
+
+	for i := range durations {
+		rec := make([]byte, 8)
+		binary.BigEndian.PutUint32(rec[0:4], durations[i])
+		binary.BigEndian.PutUint32(rec[4:8], flags[i])
+		trun = append(trun, rec...)
+	}
+
+	return trun
+}
+
+func TestParseTrunKeyframeAndTimescale(t *testing.T) {
+	trun := buildTrun(
+		[]uint32{1000, 1000},
+		[]uint32{0, sampleNonSyncFlag},
+	)
+
+	c := &HlsClient{}
+	pkts := c.parseTrun(trun, 1, PktVideo, 0, 0, false, 2000, 2000)
+
+	if len(pkts) != 2 {
+		t.Fatalf("len(pkts) = %d, want 2", len(pkts))
+	}
+
+	if !pkts[0].keyframe {
+		t.Errorf("pkts[0].keyframe = false, want true (sample_is_non_sync_sample clear)")
+	}
+	if pkts[0].pts != 1000 {
+		t.Errorf("pkts[0].pts = %d, want 1000 (decodeTime 2000 at timescale 2000 -> ms)", pkts[0].pts)
+	}
+
+	if pkts[1].keyframe {
+		t.Errorf("pkts[1].keyframe = true, want false (sample_is_non_sync_sample set)")
+	}
+	if pkts[1].pts != 1500 {
+		t.Errorf("pkts[1].pts = %d, want 1500", pkts[1].pts)
+	}
+}
+
+func TestParseMdhdTimescale(t *testing.T) {
+	tests := []struct {
+		name   string
+		mdhd   []byte
+		wantTs uint32
+		wantOk bool
+	}{
+		{
+			name: "version 0, 32-bit creation/modification times",
+			mdhd: func() []byte {
+				b := make([]byte, 4+8+4+4)
+				binary.BigEndian.PutUint32(b[12:16], 48000)
+				return b
+			}(),
+			wantTs: 48000,
+			wantOk: true,
+		},
+		{
+			name: "version 1, 64-bit creation/modification times",
+			mdhd: func() []byte {
+				b := make([]byte, 4+16+4+4)
+				b[0] = 1
+				binary.BigEndian.PutUint32(b[20:24], 90000)
+				return b
+			}(),
+			wantTs: 90000,
+			wantOk: true,
+		},
+		{
+			name:   "too short",
+			mdhd:   []byte{0, 0, 0, 0},
+			wantTs: 0,
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, ok := parseMdhdTimescale(tt.mdhd)
+			if ts != tt.wantTs || ok != tt.wantOk {
+				t.Fatalf("parseMdhdTimescale() = (%d, %v), want (%d, %v)", ts, ok, tt.wantTs, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grafov/m3u8 doesn't parse LL-HLS's #EXT-X-SERVER-CONTROL, #EXT-X-PART or
+// #EXT-X-PRELOAD-HINT tags, so HlsClient scans the raw playlist text for
+// them itself alongside the library's decode of the regular tags.
+
+type partialSegment struct {
+	uri   string
+	index int
+}
+
+// applyServerControl reads #EXT-X-SERVER-CONTROL and records whether the
+// server supports blocking playlist reloads and its part hold-back.
+func (c *HlsClient) applyServerControl(data []byte) {
+	line := findTag(data, "#EXT-X-SERVER-CONTROL")
+	if line == "" {
+		return
+	}
+
+	attrs := parseAttributeList(line)
+	c.canBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+
+	if v, ok := attrs["PART-HOLD-BACK"]; ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			c.partHoldBack = time.Duration(f * float64(time.Second))
+		}
+	}
+}
+
+// applyPreloadHint fires off a background fetch of the next part as soon as
+// the server announces it via #EXT-X-PRELOAD-HINT, so it's already in
+// c.preloadCache by the time Read() asks for it.
+func (c *HlsClient) applyPreloadHint(data []byte) {
+	line := findTag(data, "#EXT-X-PRELOAD-HINT")
+	if line == "" {
+		return
+	}
+
+	attrs := parseAttributeList(line)
+	uri := c.resolveUrl(attrs["URI"])
+	if uri == "" || uri == c.preloadHintUrl {
+		return
+	}
+
+	c.preloadHintUrl = uri
+	go c.prefetch(uri)
+}
+
+// applyPartialSegments enqueues #EXT-X-PART segments for the media sequence
+// currently being filled in (c.lastSeqId+1, i.e. not yet announced as a
+// complete segment) and advances the (msn, part) cursor used to build the
+// next blocking-reload request.
+func (c *HlsClient) applyPartialSegments(data []byte) {
+	if !c.canBlockReload {
+		return
+	}
+
+	inProgressMsn := c.lastSeqId + 1
+	if inProgressMsn != c.nextPartMsn {
+		c.nextPartMsn = inProgressMsn
+		c.nextPartIndex = 0
+	}
+
+	for _, part := range parsePartialSegments(data)[inProgressMsn] {
+		if part.index < c.nextPartIndex {
+			continue
+		}
+
+		c.playlist = append(c.playlist, Segment{
+			url:    c.resolveUrl(part.uri),
+			seqId:  uint64(inProgressMsn),
+			isPart: true,
+			part:   part.index,
+		})
+		c.nextPartIndex = part.index + 1
+		c.partsConsumedMsn = inProgressMsn
+	}
+}
+
+// parsePartialSegments walks the raw playlist text and groups #EXT-X-PART
+// tags by the media sequence number of the segment they belong to. Parts
+// that trail the last #EXTINF/URI pair describe the segment still being
+// filled in, at msn = (last complete segment's msn) + 1.
+func parsePartialSegments(data []byte) map[int64][]partialSegment {
+	result := make(map[int64][]partialSegment)
+	msn := int64(-1)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			if v, err := strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64); err == nil {
+				msn = v
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			if msn < 0 {
+				continue
+			}
+
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-PART:"))
+			parts := result[msn]
+			result[msn] = append(parts, partialSegment{
+				uri:   attrs["URI"],
+				index: len(parts),
+			})
+
+		case strings.HasPrefix(line, "#EXTINF:"):
+			msn++
+		}
+	}
+
+	return result
+}
+
+// findTag returns the attribute-list text following the first occurrence
+// of tag in data, or "" if the tag isn't present.
+func findTag(data []byte, tag string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	prefix := tag + ":"
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+
+	return ""
+}
+
+// parseAttributeList parses a HLS attribute list (KEY=VALUE,KEY="VALUE",...),
+// respecting commas inside quoted values.
+func parseAttributeList(s string) map[string]string {
+	attrs := make(map[string]string)
+
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var val string
+		if len(s) > 0 && s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val = s[1 : 1+end]
+				s = s[1+end+1:]
+				s = strings.TrimPrefix(s, ",")
+			}
+		} else if i := strings.IndexByte(s, ','); i >= 0 {
+			val, s = s[:i], s[i+1:]
+		} else {
+			val, s = s, ""
+		}
+
+		attrs[key] = val
+	}
+
+	return attrs
+}
+
+func addBlockingReloadParams(rawUrl string, msn int64, part int) string {
+	if msn < 0 {
+		return rawUrl
+	}
+
+	sep := "?"
+	if strings.Contains(rawUrl, "?") {
+		sep = "&"
+	}
+
+	return fmt.Sprintf("%s%s_HLS_msn=%d&_HLS_part=%d", rawUrl, sep, msn, part)
+}
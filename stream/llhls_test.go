@@ -0,0 +1,42 @@
+package stream
+
+import "testing"
+
+const testLLHLSPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:5
+#EXTINF:6.0,
+segment5.ts
+#EXTINF:6.0,
+segment6.ts
+`
+
+// TestDecodeM3u8SkipsPartsConsumedSegment covers the bug where a segment
+// already streamed part-by-part via #EXT-X-PART (and so skipped instead of
+// re-downloaded whole) left c.lastSeqId behind, turning the next
+// blocking-reload request into a busy-poll against a msn the server had
+// already moved past.
+func TestDecodeM3u8SkipsPartsConsumedSegment(t *testing.T) {
+	c := &HlsClient{
+		scheme:           "http",
+		host:             "example.com",
+		lastSeqId:        4,
+		partsConsumedMsn: 5,
+	}
+
+	if _, err := c.decodeM3u8([]byte(testLLHLSPlaylist)); err != nil {
+		t.Fatalf("decodeM3u8: %v", err)
+	}
+
+	if c.lastSeqId != 6 {
+		t.Fatalf("lastSeqId = %d, want 6 (must advance past the skipped segment 5)", c.lastSeqId)
+	}
+
+	if len(c.playlist) != 1 {
+		t.Fatalf("len(playlist) = %d, want 1 (segment 5 should be skipped, not re-downloaded)", len(c.playlist))
+	}
+	if c.playlist[0].seqId != 6 {
+		t.Fatalf("playlist[0].seqId = %d, want 6", c.playlist[0].seqId)
+	}
+}
@@ -0,0 +1,585 @@
+package stream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	mhttp "github.com/qiniu/httpping/http"
+)
+
+// RTMP message type IDs we care about (the rest are forwarded to ErrTryAgain).
+const (
+	rtmpMsgSetChunkSize = 1
+	rtmpMsgAudio        = 8
+	rtmpMsgVideo        = 9
+	rtmpMsgAmf0Data     = 18
+	rtmpMsgAmf0Command  = 20
+)
+
+var ErrRtmpHandshakeFailed = errors.New("rtmp handshake failed")
+
+// rtmpExtendedTimestampMarker is the escape value a chunk header's 24-bit
+// timestamp/delta field carries when the real value no longer fits in 24
+// bits (streams running past ~4.66 hours): the field is pinned to
+// 0xFFFFFF and a 4-byte big-endian absolute timestamp/delta follows the
+// rest of the header instead.
+const rtmpExtendedTimestampMarker = 0xFFFFFF
+
+// RtmpClient pulls rtmp:// / rtmps:// streams: handshake, connect/createStream/play,
+// then demux the resulting audio/video chunk stream into AVPackets the same
+// way FlvClient does for its tag stream.
+type RtmpClient struct {
+	url     string
+	timeout time.Duration
+
+	conn           net.Conn
+	readChunkSize  uint32
+	writeChunkSize uint32
+	chunkStreams   map[uint32]*rtmpChunkState
+	streamId       uint32
+
+	info          *StreamInfo
+	gotFirstChunk bool
+}
+
+type rtmpChunkState struct {
+	timestamp uint32
+	length    uint32
+	typeId    uint8
+	streamId  uint32
+	payload   []byte
+
+	// extended is set when the chunk stream's fmt 0/1/2 header carried the
+	// 0xFFFFFF escape value, meaning every chunk of this stream (including
+	// fmt 3 continuations) carries a 4-byte absolute/delta timestamp right
+	// after the header. Streams run long enough to overflow the 24-bit
+	// field (~4.66 hours) hit this.
+	extended bool
+}
+
+func (c *RtmpClient) Connect() (*StreamInfo, error) {
+	info := &StreamInfo{StartTime: time.Now()}
+
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return info, err
+	}
+
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		if u.Scheme == "rtmps" {
+			host += ":443"
+		} else {
+			host += ":1935"
+		}
+	}
+
+	tcp := &mhttp.TcpWrapper{}
+	ctx := context.Background()
+
+	var conn net.Conn
+	if u.Scheme == "rtmps" {
+		conn, err = tcp.DialTLS(ctx, "tcp", host)
+	} else {
+		conn, err = tcp.Dial(ctx, "tcp", host)
+	}
+	if err != nil {
+		info.ErrCode = ErrTcpConnectTimeout
+		return info, err
+	}
+
+	c.conn = conn
+	c.readChunkSize = 128
+	c.writeChunkSize = 128
+	c.chunkStreams = make(map[uint32]*rtmpChunkState)
+
+	info.IsConnected = true
+	info.DnsTimeMs = uint32(tcp.DnsTime().Milliseconds())
+	info.TcpConnectTimeMs = uint32(tcp.TcpHandshake().Milliseconds())
+	info.TLSHandshakeTimeMs = uint32(tcp.TlsHandshake().Milliseconds())
+	info.RemoteAddr = conn.RemoteAddr().String()
+	info.LocalAddr = conn.LocalAddr().String()
+
+	handshakeStart := time.Now()
+	if err := c.handshake(); err != nil {
+		return info, err
+	}
+	info.HandshakeTimeMs = uint32(time.Since(handshakeStart).Milliseconds())
+
+	app := strings.TrimPrefix(u.Path, "/")
+	streamName := ""
+	if i := strings.IndexByte(app, '/'); i >= 0 {
+		streamName = app[i+1:]
+		app = app[:i]
+	}
+	tcUrl := u.Scheme + "://" + u.Host + "/" + app
+
+	if err := c.sendConnect(app, tcUrl); err != nil {
+		return info, err
+	}
+	if err := c.waitAmf0Result(1); err != nil {
+		return info, err
+	}
+
+	if err := c.sendCreateStream(); err != nil {
+		return info, err
+	}
+	if err := c.waitCreateStreamResult(); err != nil {
+		return info, err
+	}
+
+	if err := c.sendPlay(streamName); err != nil {
+		return info, err
+	}
+
+	c.info = info
+	return info, nil
+}
+
+// handshake performs the uncompressed C0/C1/C2 <-> S0/S1/S2 exchange.
+func (c *RtmpClient) handshake() error {
+	c1 := make([]byte, 1536)
+	rand.Read(c1[8:])
+
+	c0c1 := make([]byte, 1537)
+	c0c1[0] = 3 // RTMP version
+	copy(c0c1[1:], c1)
+
+	if _, err := c.conn.Write(c0c1); err != nil {
+		return err
+	}
+
+	s0s1 := make([]byte, 1537)
+	if _, err := io.ReadFull(c.conn, s0s1); err != nil {
+		return err
+	}
+	if s0s1[0] != 3 {
+		return ErrRtmpHandshakeFailed
+	}
+
+	s1 := s0s1[1:]
+	if _, err := c.conn.Write(s1); err != nil {
+		return err
+	}
+
+	s2 := make([]byte, 1536)
+	if _, err := io.ReadFull(c.conn, s2); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *RtmpClient) sendConnect(app, tcUrl string) error {
+	payload := append(encodeAmf0("connect"), encodeAmf0(float64(1))...)
+	payload = append(payload, encodeAmf0([]amf0Pair{
+		{"app", app},
+		{"type", "nonprivate"},
+		{"flashVer", "httpping/1.0"},
+		{"tcUrl", tcUrl},
+	})...)
+
+	return c.writeMessage(3, rtmpMsgAmf0Command, 0, payload)
+}
+
+func (c *RtmpClient) sendCreateStream() error {
+	payload := append(encodeAmf0("createStream"), encodeAmf0(float64(2))...)
+	payload = append(payload, encodeAmf0(nil)...)
+
+	return c.writeMessage(3, rtmpMsgAmf0Command, 0, payload)
+}
+
+func (c *RtmpClient) sendPlay(streamName string) error {
+	payload := append(encodeAmf0("play"), encodeAmf0(float64(0))...)
+	payload = append(payload, encodeAmf0(nil)...)
+	payload = append(payload, encodeAmf0(streamName)...)
+
+	return c.writeMessage(8, rtmpMsgAmf0Command, c.streamId, payload)
+}
+
+// waitAmf0Result blocks until an AMF0 "_result"/"_error" reply for the given
+// transaction ID arrives, swallowing any protocol-control messages along
+// the way.
+func (c *RtmpClient) waitAmf0Result(transactionId float64) error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		if c.handleControlMessage(msg) {
+			continue
+		}
+
+		if msg.typeId != rtmpMsgAmf0Command {
+			continue
+		}
+
+		cmd, rest, err := decodeAmf0(msg.payload)
+		if err != nil {
+			continue
+		}
+		name, _ := cmd.(string)
+
+		txn, _, err := decodeAmf0(rest)
+		if err != nil {
+			continue
+		}
+		id, _ := txn.(float64)
+
+		if id == transactionId && (name == "_result" || name == "_error") {
+			if name == "_error" {
+				return errors.New("rtmp command rejected: " + name)
+			}
+			return nil
+		}
+	}
+}
+
+// waitCreateStreamResult is like waitAmf0Result(2) but also captures the
+// NetStream ID the server hands back in the reply.
+func (c *RtmpClient) waitCreateStreamResult() error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		if c.handleControlMessage(msg) {
+			continue
+		}
+
+		if msg.typeId != rtmpMsgAmf0Command {
+			continue
+		}
+
+		cmd, rest, err := decodeAmf0(msg.payload)
+		if err != nil {
+			continue
+		}
+		name, _ := cmd.(string)
+
+		txn, rest, err := decodeAmf0(rest)
+		if err != nil {
+			continue
+		}
+		id, _ := txn.(float64)
+		if id != 2 {
+			continue
+		}
+
+		if name == "_error" {
+			return errors.New("rtmp createStream rejected")
+		}
+
+		// command object (usually null), then the new stream ID.
+		_, rest, err = decodeAmf0(rest)
+		if err != nil {
+			return err
+		}
+
+		streamId, rest, err := decodeAmf0(rest)
+		if err != nil {
+			return err
+		}
+		if f, ok := streamId.(float64); ok {
+			c.streamId = uint32(f)
+		}
+
+		return nil
+	}
+}
+
+// handleControlMessage applies a Set Chunk Size protocol-control message
+// and reports whether msg was one. Other control messages (window ack
+// size, ...) are not applied here; Read() drops them because they are
+// neither audio nor video.
+func (c *RtmpClient) handleControlMessage(msg *rtmpChunkState) bool {
+	if msg.typeId != rtmpMsgSetChunkSize {
+		return false
+	}
+
+	if len(msg.payload) >= 4 {
+		c.readChunkSize = binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+	}
+
+	return true
+}
+
+func (c *RtmpClient) Read() (*AVPacket, error) {
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.handleControlMessage(msg) {
+		return nil, ErrTryAgain
+	}
+
+	if msg.typeId != rtmpMsgAudio && msg.typeId != rtmpMsgVideo {
+		return nil, ErrTryAgain
+	}
+
+	if !c.gotFirstChunk {
+		c.gotFirstChunk = true
+		if c.info != nil {
+			c.info.TtfbMs = uint32(time.Since(c.info.StartTime).Milliseconds())
+		}
+	}
+
+	return decodeRtmpMediaMessage(msg)
+}
+
+// decodeRtmpMediaMessage mirrors FlvClient.Read(): RTMP audio/video message
+// bodies use the exact same tag-body layout as FLV audio/video tags.
+func decodeRtmpMediaMessage(msg *rtmpChunkState) (*AVPacket, error) {
+	data := msg.payload
+
+	if msg.typeId == rtmpMsgVideo {
+		if len(data) < 5 {
+			return nil, ErrTryAgain
+		}
+
+		frameType := data[0] >> 4
+		compositionTime := int32(data[2])<<16 | int32(data[3])<<8 | int32(data[4])
+
+		return &AVPacket{
+			pts:      uint32(int32(msg.timestamp) + compositionTime),
+			pktType:  PktVideo,
+			keyframe: frameType == 1,
+			trackId:  flvTrackVideo,
+		}, nil
+	}
+
+	// audio
+	if len(data) < 2 {
+		return nil, ErrTryAgain
+	}
+
+	soundFormat := data[0] >> 4
+	if soundFormat == 10 && data[1] != 1 {
+		// AAC sequence header, not a raw frame.
+		return nil, ErrTryAgain
+	}
+
+	return &AVPacket{
+		pts:      msg.timestamp,
+		pktType:  PktAudio,
+		keyframe: false,
+		trackId:  flvTrackAudio,
+	}, nil
+}
+
+func (c *RtmpClient) Close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// readMessage reads chunks off the wire until a full RTMP message has been
+// reassembled across however many chunk-stream IDs are interleaved.
+func (c *RtmpClient) readMessage() (*rtmpChunkState, error) {
+	for {
+		state, complete, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if complete {
+			msg := &rtmpChunkState{
+				timestamp: state.timestamp,
+				length:    state.length,
+				typeId:    state.typeId,
+				streamId:  state.streamId,
+				payload:   append([]byte(nil), state.payload...),
+			}
+			state.payload = state.payload[:0]
+			return msg, nil
+		}
+	}
+}
+
+func (c *RtmpClient) readChunk() (*rtmpChunkState, bool, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(c.conn, first); err != nil {
+		return nil, false, err
+	}
+
+	fmtType := first[0] >> 6
+	csid := uint32(first[0] & 0x3f)
+
+	switch csid {
+	case 0:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			return nil, false, err
+		}
+		csid = uint32(b[0]) + 64
+	case 1:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			return nil, false, err
+		}
+		csid = uint32(binary.LittleEndian.Uint16(b)) + 64
+	}
+
+	state, ok := c.chunkStreams[csid]
+	if !ok {
+		state = &rtmpChunkState{}
+		c.chunkStreams[csid] = state
+	}
+
+	switch fmtType {
+	case 0:
+		hdr := make([]byte, 11)
+		if _, err := io.ReadFull(c.conn, hdr); err != nil {
+			return nil, false, err
+		}
+		ts := uint24(hdr[0:3])
+		state.length = uint24(hdr[3:6])
+		state.typeId = hdr[6]
+		state.streamId = binary.LittleEndian.Uint32(hdr[7:11])
+		state.payload = state.payload[:0]
+
+		state.extended = ts == rtmpExtendedTimestampMarker
+		if state.extended {
+			extTs, err := c.readExtendedTimestamp()
+			if err != nil {
+				return nil, false, err
+			}
+			ts = extTs
+		}
+		state.timestamp = ts
+
+	case 1:
+		hdr := make([]byte, 7)
+		if _, err := io.ReadFull(c.conn, hdr); err != nil {
+			return nil, false, err
+		}
+		delta := uint24(hdr[0:3])
+		state.length = uint24(hdr[3:6])
+		state.typeId = hdr[6]
+		state.payload = state.payload[:0]
+
+		state.extended = delta == rtmpExtendedTimestampMarker
+		if state.extended {
+			extDelta, err := c.readExtendedTimestamp()
+			if err != nil {
+				return nil, false, err
+			}
+			delta = extDelta
+		}
+		state.timestamp += delta
+
+	case 2:
+		hdr := make([]byte, 3)
+		if _, err := io.ReadFull(c.conn, hdr); err != nil {
+			return nil, false, err
+		}
+		delta := uint24(hdr[0:3])
+		state.payload = state.payload[:0]
+
+		state.extended = delta == rtmpExtendedTimestampMarker
+		if state.extended {
+			extDelta, err := c.readExtendedTimestamp()
+			if err != nil {
+				return nil, false, err
+			}
+			delta = extDelta
+		}
+		state.timestamp += delta
+
+	case 3:
+		// Continuation of the in-progress message, header otherwise
+		// unchanged; but if the chunk stream is in extended-timestamp mode
+		// (set by whichever fmt 0/1/2 header started this message), every
+		// fmt 3 chunk repeats the same 4-byte field and must be consumed
+		// here or it gets misread as payload.
+		if state.extended {
+			if _, err := c.readExtendedTimestamp(); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	remaining := int(state.length) - len(state.payload)
+	if remaining > int(c.readChunkSize) {
+		remaining = int(c.readChunkSize)
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	chunk := make([]byte, remaining)
+	if remaining > 0 {
+		if _, err := io.ReadFull(c.conn, chunk); err != nil {
+			return nil, false, err
+		}
+	}
+	state.payload = append(state.payload, chunk...)
+
+	return state, uint32(len(state.payload)) >= state.length, nil
+}
+
+// readExtendedTimestamp reads the 4-byte big-endian field that follows a
+// chunk header whose 24-bit timestamp/delta was rtmpExtendedTimestampMarker.
+func (c *RtmpClient) readExtendedTimestamp() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// writeMessage chunks payload into c.writeChunkSize-sized pieces, using a
+// full (fmt 0) header for the first chunk and 1-byte continuation (fmt 3)
+// headers for the rest.
+func (c *RtmpClient) writeMessage(csid uint32, typeId uint8, streamId uint32, payload []byte) error {
+	header := make([]byte, 12)
+	header[0] = byte(csid)
+	putUint24(header[1:4], 0)
+	putUint24(header[4:7], uint32(len(payload)))
+	header[7] = typeId
+	binary.LittleEndian.PutUint32(header[8:12], streamId)
+
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+
+	for len(payload) > 0 {
+		n := int(c.writeChunkSize)
+		if n > len(payload) {
+			n = len(payload)
+		}
+
+		if _, err := c.conn.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+
+		if len(payload) > 0 {
+			if _, err := c.conn.Write([]byte{0xc0 | byte(csid)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
@@ -1,11 +1,13 @@
 package stream
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"path"
@@ -24,6 +26,31 @@ type Prober struct {
 	PlayerBufferTimeMs uint32
 	ProbeTimeSec       uint32
 	Header             map[string]string
+
+	// Observer, if set, is pushed a StreamInfo snapshot as probe lifecycle
+	// events happen (connect, first video/audio, stall/resume, a periodic
+	// tick, and end), turning a probe into a continuous stream of
+	// observations rather than one result collected at the very end.
+	Observer Observer
+	// TickIntervalMs is how often Observer.OnTick fires while the player
+	// is running. Zero disables the periodic tick (other events still
+	// fire normally).
+	TickIntervalMs uint32
+}
+
+// Observer receives StreamInfo snapshots as a probe progresses. Every
+// method is called with the probe's live *StreamInfo, which is mutated in
+// place over the probe's lifetime (the same pointer Prober.Do eventually
+// returns), so an Observer that retains it beyond the call should copy the
+// fields it cares about.
+type Observer interface {
+	OnConnect(info *StreamInfo)
+	OnFirstVideo(info *StreamInfo)
+	OnFirstAudio(info *StreamInfo)
+	OnStall(info *StreamInfo)
+	OnResume(info *StreamInfo)
+	OnTick(info *StreamInfo)
+	OnEnd(info *StreamInfo)
 }
 
 type StreamInfo struct {
@@ -34,16 +61,66 @@ type StreamInfo struct {
 	DnsTimeMs           uint32
 	TcpConnectTimeMs    uint32
 	TLSHandshakeTimeMs  uint32
+	HandshakeTimeMs     uint32
 	TtfbMs              uint32
 	FirstVideoPktTimeMs uint32
 	FirstAudioPktTimeMs uint32
-	TotalLagTimeMs      uint32
-	TotalLagCount       uint32
 	VideoFps            float32
-	LagRate             float32
 	HttpCode            int
 	RemoteAddr          string
 	LocalAddr           string
+
+	// QoE summary, modeled on the ITU-T P.1203 / Dash.js approach of scoring
+	// startup delay and steady-state rebuffering separately rather than one
+	// lumped lag counter. StartupDelayMs is wall-clock from Connect to the
+	// first frame actually rendered; the Stall* fields only cover rebuffers
+	// that happen during playback afterwards.
+	StartupDelayMs             uint32
+	StallCountSteadyState      uint32
+	StallDurationMsSteadyState uint32
+	// StallDurationHistogramMs buckets steady-state stalls by duration:
+	// index 0 = <1s, 1 = 1-3s, 2 = 3-10s, 3 = 10s+.
+	StallDurationHistogramMs [4]uint32
+	LagRate                  float32
+	// MeanOpinionScore is a closed-form MOS estimate (1.0-5.0) combining
+	// startup delay, stall ratio and stall frequency. See computeMOS.
+	MeanOpinionScore float32
+	// AvgVideoBitrateKbps averages the per-GOP bitrate computed from the
+	// encoded payload bytes (TS/FLV only, see AVPacket.size) between
+	// consecutive video keyframes.
+	AvgVideoBitrateKbps uint32
+
+	// LL-HLS only: set when the playlist advertises CAN-BLOCK-RELOAD and at
+	// least one #EXT-X-PART has been downloaded.
+	FirstPartTimeMs    uint32
+	PartDownloadTimeMs uint32
+
+	// WHEP only: ICE/DTLS negotiation timing and RTCP-derived quality stats
+	// for the inbound RTP streams.
+	IceGatheringTimeMs  uint32
+	DtlsHandshakeTimeMs uint32
+	FirstRtpPktTimeMs   uint32
+	JitterMs            float32
+	PacketLossRate      float32
+	NackCount           uint32
+	PliCount            uint32
+
+	// Tracks lists every elementary stream discovered in the source,
+	// populated as soon as the container's track metadata (PMT, init
+	// segment, onMetaData, ...) has been parsed.
+	Tracks []TrackInfo
+}
+
+// addTrack registers or updates a TrackInfo by TrackID.
+func (info *StreamInfo) addTrack(t TrackInfo) {
+	for i := range info.Tracks {
+		if info.Tracks[i].TrackID == t.TrackID {
+			info.Tracks[i] = t
+			return
+		}
+	}
+
+	info.Tracks = append(info.Tracks, t)
 }
 
 func (info *StreamInfo) init(tcp *mhttp.TcpWrapper, resp *http.Response) {
@@ -61,6 +138,32 @@ type AVPacket struct {
 	pktType  uint32
 	pts      uint32
 	keyframe bool
+	trackId  uint32
+
+	// size is the encoded payload size in bytes, used to estimate
+	// AvgVideoBitrateKbps. Only the TS and FLV demuxers populate it; it's
+	// left 0 for fMP4/RTMP/WHEP packets.
+	size uint32
+}
+
+// TrackInfo describes one elementary stream (audio, video, or timed
+// metadata) discovered while probing. Width/Height are left zero when the
+// container doesn't advertise them up front. BitrateKbps starts at zero;
+// Fps starts at the onMetaData framerate for FLV and at zero otherwise.
+// Both are overwritten once Player has measured enough packets of that
+// track to estimate them (video tracks only; see trackBitrateEstimator and
+// trackFpsEstimator).
+type TrackInfo struct {
+	TrackID     uint32
+	Type        uint32 // PktVideo, PktAudio, or PktMetadata
+	Codec       string
+	Language    string
+	SampleRate  uint32
+	Channels    uint32
+	Width       uint32
+	Height      uint32
+	BitrateKbps uint32
+	Fps         float32
 }
 
 type Player struct {
@@ -71,6 +174,18 @@ type Player struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	info         *StreamInfo
+	fpsByTrack   map[uint32]*trackFpsEstimator
+
+	// gop tracks encoded bytes since the last video keyframe, used to
+	// sample an instantaneous bitrate each time a new keyframe starts.
+	gopStart           time.Time
+	gopBytes           uint64
+	bitrateSampleCount uint32
+	bitrateMeanKbps    float64
+	bitrateByTrack     map[uint32]*trackBitrateEstimator
+
+	observer     Observer
+	tickInterval time.Duration
 }
 
 type Client interface {
@@ -85,8 +200,16 @@ type FlvClient struct {
 	timeout  time.Duration
 	response *http.Response
 	decoder  *flv.Decoder
+	info     *StreamInfo
 }
 
+// FLV has no stream-level track IDs of its own, so the legacy single video
+// and audio tags are pinned to 0/1, matching the convention used for RTMP.
+const (
+	flvTrackVideo = 0
+	flvTrackAudio = 1
+)
+
 func (c *FlvClient) Connect() (*StreamInfo, error) {
 	info := &StreamInfo{StartTime: time.Now()}
 	req, err := newRequest(c.url, nil)
@@ -117,6 +240,7 @@ func (c *FlvClient) Connect() (*StreamInfo, error) {
 		return info, err
 	}
 
+	c.info = info
 	return info, nil
 }
 
@@ -132,6 +256,15 @@ func (c *FlvClient) Read() (*AVPacket, error) {
 
 	if flvTag.TagType == tag.TagTypeVideo {
 		videoData := (flvTag.Data).(*tag.VideoData)
+
+		// go-flv only knows the legacy CodecID byte, so for "enhanced RTMP"
+		// tags the top bit it folds into FrameType is really the extended
+		// header marker. Reconstruct the original byte to tell them apart.
+		raw := uint8(videoData.FrameType)<<4 | uint8(videoData.CodecID)
+		if raw&flvEnhancedMarker != 0 {
+			return c.readEnhancedVideoTag(flvTag.Timestamp, raw, videoData)
+		}
+
 		pts := int32(flvTag.Timestamp) + videoData.CompositionTime
 		keyframe := videoData.FrameType == tag.FrameTypeKeyFrame
 
@@ -139,6 +272,8 @@ func (c *FlvClient) Read() (*AVPacket, error) {
 			pts:      uint32(pts),
 			pktType:  PktVideo,
 			keyframe: keyframe,
+			trackId:  flvTrackVideo,
+			size:     payloadSize(videoData.Data),
 		}, nil
 	} else if flvTag.TagType == tag.TagTypeAudio {
 		pts := flvTag.Timestamp
@@ -148,22 +283,163 @@ func (c *FlvClient) Read() (*AVPacket, error) {
 				pts:      pts,
 				pktType:  PktAudio,
 				keyframe: false,
+				trackId:  flvTrackAudio,
+				size:     payloadSize(audioData.Data),
 			}, nil
 		}
+	} else if flvTag.TagType == tag.TagTypeScriptData {
+		c.registerTracksFromMetaData((flvTag.Data).(*tag.ScriptData))
 	}
 
 	return nil, ErrTryAgain
 }
 
+// Enhanced RTMP (the mux.dev v1 spec) stuffs an "is extended header" bit
+// into what legacy FLV treats as the top bit of FrameType, followed by a
+// 4-byte FourCC in place of the legacy CodecID-driven body. go-flv doesn't
+// know about this, but it still leaves those bytes untouched in
+// videoData.Data for any CodecID other than AVC, so they can be read here.
+const flvEnhancedMarker = 0x80
+
+const (
+	flvPacketTypeSequenceStart = 0
+	flvPacketTypeCodedFrames   = 1
+	flvPacketTypeSequenceEnd   = 2
+)
+
+func (c *FlvClient) readEnhancedVideoTag(timestamp uint32, raw uint8, videoData *tag.VideoData) (*AVPacket, error) {
+	packetType := raw & 0x0f
+	frameType := (raw >> 4) & 0x07
+
+	fourCC := make([]byte, 4)
+	if _, err := io.ReadFull(videoData.Data, fourCC); err != nil {
+		return nil, ErrTryAgain
+	}
+
+	if c.info != nil {
+		c.info.addTrack(TrackInfo{TrackID: flvTrackVideo, Type: PktVideo, Codec: strings.ToLower(string(fourCC))})
+	}
+
+	if packetType != flvPacketTypeCodedFrames {
+		return nil, ErrTryAgain
+	}
+
+	var compositionTime int32
+	ctBuf := make([]byte, 3)
+	if _, err := io.ReadFull(videoData.Data, ctBuf); err == nil {
+		compositionTime = int32(ctBuf[0])<<16 | int32(ctBuf[1])<<8 | int32(ctBuf[2])
+		if compositionTime&0x800000 != 0 {
+			compositionTime |= -1 << 24 // sign-extend the 24-bit value
+		}
+	}
+
+	return &AVPacket{
+		pts:      uint32(int32(timestamp) + compositionTime),
+		pktType:  PktVideo,
+		keyframe: frameType == 1,
+		trackId:  flvTrackVideo,
+		size:     payloadSize(videoData.Data),
+	}, nil
+}
+
+// payloadSize drains the rest of a tag's payload reader to measure its
+// size. FlvTag.Close() would otherwise discard these bytes unread, so this
+// doesn't cost an extra pass over the stream.
+func payloadSize(r io.Reader) uint32 {
+	n, _ := io.Copy(io.Discard, r)
+	return uint32(n)
+}
+
+// flvVideoCodecNames maps the legacy numeric FLV videocodecid to a short
+// codec name, at the same granularity TrackInfo.Codec uses for TS/fMP4.
+var flvVideoCodecNames = map[float64]string{
+	2: "h263",
+	3: "screen",
+	4: "vp6",
+	5: "vp6a",
+	6: "screen2",
+	7: "h264",
+}
+
+var flvAudioCodecNames = map[float64]string{
+	2:  "mp3",
+	10: "aac",
+	11: "speex",
+}
+
+// registerTracksFromMetaData reads the onMetaData object most FLV encoders
+// write as the very first tag and uses it to populate StreamInfo.Tracks
+// before any real audio/video tag has arrived.
+func (c *FlvClient) registerTracksFromMetaData(sd *tag.ScriptData) {
+	if c.info == nil {
+		return
+	}
+
+	meta, ok := sd.Objects["onMetaData"]
+	if !ok {
+		return
+	}
+
+	if _, hasVideo := meta["videocodecid"]; hasVideo {
+		c.info.addTrack(TrackInfo{
+			TrackID: flvTrackVideo,
+			Type:    PktVideo,
+			Codec:   flvCodecName(meta, "videocodecid", flvVideoCodecNames),
+			Width:   uint32(metaNumber(meta, "width")),
+			Height:  uint32(metaNumber(meta, "height")),
+			Fps:     float32(metaNumber(meta, "framerate")),
+		})
+	}
+
+	if _, hasAudio := meta["audiocodecid"]; hasAudio {
+		c.info.addTrack(TrackInfo{
+			TrackID:    flvTrackAudio,
+			Type:       PktAudio,
+			Codec:      flvCodecName(meta, "audiocodecid", flvAudioCodecNames),
+			SampleRate: uint32(metaNumber(meta, "audiosamplerate")),
+			Channels:   uint32(metaNumber(meta, "audiochannels")),
+		})
+	}
+}
+
+// flvCodecName resolves a *codecid onMetaData field to a short codec name.
+// Legacy encoders write a numeric ID; enhanced-RTMP ones may write the
+// FourCC directly as a string (e.g. videocodecid="hvc1").
+func flvCodecName(meta map[string]interface{}, key string, legacyNames map[float64]string) string {
+	switch v := meta[key].(type) {
+	case string:
+		return strings.ToLower(v)
+	case float64:
+		return legacyNames[v]
+	}
+
+	return ""
+}
+
+func metaNumber(meta map[string]interface{}, key string) float64 {
+	if v, ok := meta[key].(float64); ok {
+		return v
+	}
+
+	return 0
+}
+
 func (c *FlvClient) Close() {
 	if c.response != nil {
 		c.response.Body.Close()
 	}
 }
 
-type TsSegment struct {
-	url   string
-	seqId uint64
+// Segment describes one media segment referenced by the playlist. For
+// fMP4/CMAF streams initUrl points at the #EXT-X-MAP init segment that must
+// be fetched (and cached) before the segment itself can be demuxed. isPart
+// marks an LL-HLS #EXT-X-PART partial segment rather than a complete one.
+type Segment struct {
+	url     string
+	seqId   uint64
+	initUrl string
+	isPart  bool
+	part    int
 }
 
 type HlsClient struct {
@@ -175,12 +451,35 @@ type HlsClient struct {
 	timeout       time.Duration
 	m3u8Ctx       context.Context
 	m3u8Cancel    context.CancelFunc
-	playlist      []TsSegment
+	playlist      []Segment
 	lastSeqId     int64
 	mutex         sync.Mutex
 	buffer        []byte
 	pat           PAT
 	pmt           PMT
+	info          *StreamInfo
+
+	container       uint32
+	initSegmentUrl  string
+	trackTypes      map[uint32]uint32
+	trackTimescales map[uint32]uint32
+	samples         []AVPacket
+
+	// LL-HLS state.
+	canBlockReload bool
+	partHoldBack   time.Duration
+	nextPartMsn    int64
+	nextPartIndex  int
+	preloadHintUrl string
+	preloadCache   map[string][]byte
+	preloadMutex   sync.Mutex
+	gotFirstPart   bool
+
+	// partsConsumedMsn is the media sequence number, if any, whose
+	// #EXT-X-PART segments have already been enqueued and demuxed. Once
+	// that msn's #EXTINF/URI later shows up as a complete segment, it must
+	// be skipped rather than re-downloaded and re-demuxed.
+	partsConsumedMsn int64
 }
 
 func (c *HlsClient) Connect() (*StreamInfo, error) {
@@ -209,6 +508,7 @@ func (c *HlsClient) Connect() (*StreamInfo, error) {
 		return info, nil
 	}
 
+	c.info = info
 	c.m3u8Ctx, c.m3u8Cancel = context.WithCancel(context.Background())
 	go c.downloadM3u8()
 
@@ -216,43 +516,71 @@ func (c *HlsClient) Connect() (*StreamInfo, error) {
 }
 
 func (c *HlsClient) Read() (*AVPacket, error) {
-	if len(c.buffer) == 0 {
-		var url string
+	if len(c.samples) == 0 && len(c.buffer) == 0 {
+		var seg Segment
 		c.mutex.Lock()
 		if len(c.playlist) != 0 {
-			url = c.playlist[0].url
+			seg = c.playlist[0]
 			c.playlist = c.playlist[1:]
 		}
 		c.mutex.Unlock()
 
-		if url == "" {
+		if seg.url == "" {
 			time.Sleep(time.Second)
 			return nil, ErrTryAgain
 		}
 
-		req, err := newRequest(url, nil)
-		if err != nil {
-			return nil, err
+		if seg.initUrl != "" {
+			if err := c.ensureInitSegment(seg.initUrl); err != nil {
+				return nil, err
+			}
 		}
 
-		hc := &http.Client{Timeout: c.timeout}
-		resp, err := hc.Do(req)
-		if err != nil {
-			return nil, err
+		downloadStart := time.Now()
+
+		if body := c.takePreloaded(seg.url); body != nil {
+			c.buffer = body
+		} else {
+			req, err := newRequest(seg.url, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			hc := &http.Client{Timeout: c.timeout}
+			resp, err := hc.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				//TODO: 统计错误状态码
+				return nil, ErrTryAgain
+			}
+
+			c.buffer, err = ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != 200 {
-			//TODO: 统计错误状态码
-			return nil, ErrTryAgain
+		if c.container == ContainerUnknown {
+			c.container = detectContainer(seg.initUrl, c.buffer)
 		}
 
-		c.buffer, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+		if seg.isPart && c.info != nil {
+			c.info.PartDownloadTimeMs = uint32(time.Since(downloadStart).Milliseconds())
+			if !c.gotFirstPart {
+				c.gotFirstPart = true
+				c.info.FirstPartTimeMs = uint32(time.Since(c.info.StartTime).Milliseconds())
+			}
 		}
 	}
 
+	if c.container == ContainerFMP4 {
+		return c.demuxFmp4()
+	}
+
 	return c.demux()
 }
 
@@ -279,6 +607,8 @@ type PMT struct {
 type PMTStream struct {
 	elementaryPid uint32
 	streamType    uint32
+	registration  string // format identifier from a 0x05 registration descriptor, e.g. "AC-3", "Opus", "AV01"
+	language      string // 3-letter code from a 0x0a ISO-639 language descriptor
 }
 
 func (c *HlsClient) demux() (*AVPacket, error) {
@@ -366,11 +696,11 @@ func (c *HlsClient) demux() (*AVPacket, error) {
 
 func (c *HlsClient) decodeStream(data []byte, pid uint32, payloadStart bool) (*AVPacket, error) {
 	var found_stream bool
-	var streamType uint32
+	var stream PMTStream
 	for _, s := range c.pmt.pmtStreams {
 		if pid == s.elementaryPid {
 			found_stream = true
-			streamType = s.streamType
+			stream = s
 			break
 		}
 	}
@@ -379,11 +709,11 @@ func (c *HlsClient) decodeStream(data []byte, pid uint32, payloadStart bool) (*A
 		return nil, ErrTryAgain
 	}
 
-	var pktType uint32
-	if streamType == STREAM_TYPE_VIDEO_H264 || streamType == STREAM_TYPE_VIDEO_HEVC {
-		pktType = PktVideo
-	} else {
-		pktType = PktAudio
+	pktType := tsPktType(stream)
+	if pktType == PktMetadata {
+		// ID3 timed metadata isn't PES-framed the same way; nothing to
+		// demux into an AVPacket yet.
+		return nil, ErrTryAgain
 	}
 
 	pkt, err := c.decodePES(data, pktType)
@@ -391,9 +721,61 @@ func (c *HlsClient) decodeStream(data []byte, pid uint32, payloadStart bool) (*A
 		return nil, err
 	}
 
+	pkt.trackId = pid
 	return pkt, nil
 }
 
+// tsPktType classifies a PMT-listed elementary stream into PktVideo/
+// PktAudio/PktMetadata. STREAM_TYPE_PRIVATE_DATA is ambiguous on its own
+// (AC-3, Opus and AV1 all use it) so it falls back to the registration
+// descriptor's format identifier.
+func tsPktType(stream PMTStream) uint32 {
+	switch stream.streamType {
+	case STREAM_TYPE_VIDEO_H264, STREAM_TYPE_VIDEO_HEVC, STREAM_TYPE_VIDEO_AV1_USER:
+		return PktVideo
+	case STREAM_TYPE_ID3_METADATA:
+		return PktMetadata
+	case STREAM_TYPE_PRIVATE_DATA:
+		if stream.registration == "AV01" {
+			return PktVideo
+		}
+		return PktAudio
+	default:
+		return PktAudio
+	}
+}
+
+// tsCodecName returns a short codec name for a PMT-listed stream, matching
+// the granularity TrackInfo.Codec uses elsewhere (e.g. the fMP4 hdlr-based
+// tracks and FLV's onMetaData-derived tracks).
+func tsCodecName(stream PMTStream) string {
+	switch stream.streamType {
+	case STREAM_TYPE_VIDEO_H264:
+		return "h264"
+	case STREAM_TYPE_VIDEO_HEVC:
+		return "hevc"
+	case STREAM_TYPE_VIDEO_AV1_USER:
+		return "av1"
+	case STREAM_TYPE_AUDIO_AAC:
+		return "aac"
+	case STREAM_TYPE_ID3_METADATA:
+		return "id3"
+	case STREAM_TYPE_PRIVATE_DATA:
+		switch stream.registration {
+		case "AC-3", "EAC3":
+			return "ac3"
+		case "Opus":
+			return "opus"
+		case "AV01":
+			return "av1"
+		default:
+			return "unknown"
+		}
+	default:
+		return "unknown"
+	}
+}
+
 func (c *HlsClient) decodePES(data []byte, pktType uint32) (*AVPacket, error) {
 	/* packet_start_code_prefix                     24 bslbf */
 	packetStartCodePrefix := (uint32(data[0]) << 16) |
@@ -467,10 +849,15 @@ func (c *HlsClient) decodePES(data []byte, pktType uint32) (*AVPacket, error) {
 
 			pts /= 90
 
+			// size is only this TS packet's share of the PES payload (the
+			// demuxer doesn't reassemble continuation packets into a full
+			// frame), so AvgVideoBitrateKbps is a rough estimate, not an
+			// exact byte count.
 			return &AVPacket{
 				pts:      uint32(pts),
 				pktType:  pktType,
 				keyframe: true,
+				size:     uint32(len(data) - 5),
 			}, nil
 
 		} else if PTS_DTS_flags == 3 {
@@ -500,6 +887,7 @@ func (c *HlsClient) decodePES(data []byte, pktType uint32) (*AVPacket, error) {
 				pts:      pts,
 				pktType:  pktType,
 				keyframe: true,
+				size:     uint32(len(data) - 5),
 			}, nil
 		}
 	}
@@ -542,18 +930,181 @@ func (c *HlsClient) decodePMT(data []byte) {
 	programInfoLength := int32((data[10]&0x0f)<<8) | int32(data[11])
 	data = data[12+programInfoLength:]
 
-	for i := int32(0); i < sectionLength-9-5 && len(data) != 0; i += 5 {
+	for i := int32(0); i < sectionLength-9-5 && len(data) >= 5; i += 5 {
 		stream := PMTStream{}
 		stream.streamType = uint32(data[0])
 		stream.elementaryPid = ((uint32(data[1]) << 8) | uint32(data[2])) & 0x1fff
 		esInfoLength := uint32(data[3]&0x0f)<<8 | uint32(data[4])
+
+		if 5+esInfoLength > uint32(len(data)) {
+			// Truncated or malformed row: esInfoLength claims more
+			// descriptor bytes than the section actually has left.
+			break
+		}
+
+		stream.registration, stream.language = decodeDescriptors(data[5 : 5+esInfoLength])
+
 		data = data[5+esInfoLength:]
 		pmt.pmtStreams = append(pmt.pmtStreams, stream)
 	}
 
 	if len(pmt.pmtStreams) != 0 {
 		c.pmt = pmt
+		c.registerTracks(pmt)
+	}
+}
+
+// decodeDescriptors walks a PMT stream's descriptor loop for the two tags
+// this package cares about: 0x05 registration (disambiguates
+// STREAM_TYPE_PRIVATE_DATA into AC-3/Opus/AV1) and 0x0a ISO-639 language.
+func decodeDescriptors(data []byte) (registration, language string) {
+	for len(data) >= 2 {
+		tag := data[0]
+		length := uint32(data[1])
+		if uint32(len(data)) < 2+length {
+			break
+		}
+
+		body := data[2 : 2+length]
+		switch tag {
+		case 0x05:
+			if len(body) >= 4 {
+				registration = string(body[0:4])
+			}
+		case 0x0a:
+			if len(body) >= 3 {
+				language = string(body[0:3])
+			}
+		}
+
+		data = data[2+length:]
+	}
+
+	return
+}
+
+// registerTracks surfaces every PMT-listed elementary stream as a
+// StreamInfo.TrackInfo entry, keyed by PID (the same value AVPacket.trackId
+// uses for TS streams).
+func (c *HlsClient) registerTracks(pmt PMT) {
+	if c.info == nil {
+		return
+	}
+
+	for _, s := range pmt.pmtStreams {
+		c.info.addTrack(TrackInfo{
+			TrackID:  s.elementaryPid,
+			Type:     tsPktType(s),
+			Codec:    tsCodecName(s),
+			Language: s.language,
+		})
+	}
+}
+
+// resolveUrl turns a (possibly relative) playlist URI into an absolute one
+// using the client's scheme/host, the same way segment URIs are resolved.
+func (c *HlsClient) resolveUrl(uri string) string {
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return uri
+	}
+
+	if strings.HasPrefix(uri, "/") {
+		return c.scheme + "://" + c.host + uri
+	}
+
+	return c.scheme + "://" + c.host + "/" + uri
+}
+
+// ensureInitSegment downloads and caches the fMP4 init segment (ftyp/moov)
+// referenced by #EXT-X-MAP, and extracts the video/audio track IDs from it.
+// It is a no-op if initUrl is already cached.
+func (c *HlsClient) ensureInitSegment(initUrl string) error {
+	if initUrl == c.initSegmentUrl && c.trackTypes != nil {
+		return nil
+	}
+
+	req, err := newRequest(initUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	hc := &http.Client{Timeout: c.timeout}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return ErrInitSegmentFetch
+	}
+
+	init, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	c.initSegmentUrl = initUrl
+	c.trackTypes = parseTrackTypes(init)
+	c.trackTimescales = parseTrackTimescales(init)
+	if c.container == ContainerUnknown {
+		c.container = ContainerFMP4
+	}
+
+	if c.info != nil {
+		for _, t := range parseTrackInfos(init) {
+			c.info.addTrack(t)
+		}
+	}
+
+	return nil
+}
+
+// prefetch eagerly downloads an #EXT-X-PRELOAD-HINT part in the background
+// (Go's http.Transport negotiates HTTP/2 over TLS on its own, so concurrent
+// part/playlist requests are pipelined over the same connection) so that by
+// the time Read() reaches it, it's already cached.
+func (c *HlsClient) prefetch(url string) {
+	req, err := newRequest(url, nil)
+	if err != nil {
+		return
+	}
+
+	hc := &http.Client{Timeout: c.timeout}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
 	}
+
+	c.preloadMutex.Lock()
+	if c.preloadCache == nil {
+		c.preloadCache = make(map[string][]byte)
+	}
+	c.preloadCache[url] = body
+	c.preloadMutex.Unlock()
+}
+
+func (c *HlsClient) takePreloaded(url string) []byte {
+	c.preloadMutex.Lock()
+	defer c.preloadMutex.Unlock()
+
+	body, ok := c.preloadCache[url]
+	if !ok {
+		return nil
+	}
+
+	delete(c.preloadCache, url)
+	return body
 }
 
 func (c *HlsClient) downloadM3u8() {
@@ -566,12 +1117,15 @@ func (c *HlsClient) downloadM3u8() {
 			return
 
 		case <-ticker.C:
-			url := c.url
+			reqUrl := c.url
 			if c.secondM3u8Url != "" {
-				url = c.secondM3u8Url
+				reqUrl = c.secondM3u8Url
+			}
+			if c.canBlockReload {
+				reqUrl = addBlockingReloadParams(reqUrl, c.nextPartMsn, c.nextPartIndex)
 			}
 
-			req, err := newRequest(url, nil)
+			req, err := newRequest(reqUrl, nil)
 			if err != nil {
 				ticker.Reset(time.Second)
 				break
@@ -585,7 +1139,13 @@ func (c *HlsClient) downloadM3u8() {
 			}
 			defer resp.Body.Close()
 
-			interval, err := c.decodeM3u8(resp.Body)
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				ticker.Reset(time.Second)
+				break
+			}
+
+			interval, err := c.decodeM3u8(data)
 			if err != nil {
 				log.Println("parse m3u8 error:", err)
 				break
@@ -596,8 +1156,8 @@ func (c *HlsClient) downloadM3u8() {
 	}
 }
 
-func (c *HlsClient) decodeM3u8(r io.Reader) (time.Duration, error) {
-	playlist, mtype, err := m3u8.DecodeFrom(r, true)
+func (c *HlsClient) decodeM3u8(data []byte) (time.Duration, error) {
+	playlist, mtype, err := m3u8.DecodeFrom(bytes.NewReader(data), true)
 	if err != nil {
 		return time.Second, err
 	}
@@ -622,37 +1182,71 @@ func (c *HlsClient) decodeM3u8(r io.Reader) (time.Duration, error) {
 			break
 		}
 
-		uri := segment.URI
-		if !(strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")) {
-			if strings.HasPrefix(uri, "/") {
-				uri = c.scheme + "://" + c.host + uri
-			} else {
-				uri = c.scheme + "://" + c.host + "/" + uri
-			}
+		if int64(segment.SeqId) == c.partsConsumedMsn {
+			// Already streamed part-by-part while it was still in
+			// progress; re-downloading and re-demuxing it whole here
+			// would hand the Player duplicate/overlapping AVPackets.
+			// lastSeqId still needs to advance past it, or
+			// applyPartialSegments keeps computing inProgressMsn from the
+			// stale msn and both the next #EXT-X-PART batch and the
+			// blocking-reload request get built against the wrong segment.
+			c.lastSeqId = int64(segment.SeqId)
+			continue
+		}
+
+		uri := c.resolveUrl(segment.URI)
+		if uri != segment.URI {
 			c.lastSeqId = int64(segment.SeqId)
 		}
 
-		log.Println("new ts url=", uri)
-		c.playlist = append(c.playlist, TsSegment{
-			url:   uri,
-			seqId: segment.SeqId,
+		var initUrl string
+		if segment.Map != nil && segment.Map.URI != "" {
+			initUrl = c.resolveUrl(segment.Map.URI)
+		}
+
+		log.Println("new segment url=", uri)
+		c.playlist = append(c.playlist, Segment{
+			url:     uri,
+			seqId:   segment.SeqId,
+			initUrl: initUrl,
 		})
 
 	}
 
+	c.applyServerControl(data)
+	c.applyPreloadHint(data)
+	c.applyPartialSegments(data)
+
+	if c.canBlockReload {
+		// The next reload blocks server-side on _HLS_msn/_HLS_part, so
+		// there's no need to also throttle client-side.
+		return time.Millisecond, nil
+	}
+
 	//time.Duration(mediaPlaylist.TargetDuration/2) * time.Second,
 	return time.Second, nil
 }
 
 const (
-	PktAudio = 0
-	PktVideo = 1
+	PktAudio    = 0
+	PktVideo    = 1
+	PktMetadata = 2
 )
 
 const (
-	STREAM_TYPE_AUDIO_AAC  = 0x0f
-	STREAM_TYPE_VIDEO_H264 = 0x1b
-	STREAM_TYPE_VIDEO_HEVC = 0x24
+	STREAM_TYPE_AUDIO_AAC      = 0x0f
+	STREAM_TYPE_VIDEO_H264     = 0x1b
+	STREAM_TYPE_VIDEO_HEVC     = 0x24
+	STREAM_TYPE_PRIVATE_DATA   = 0x06 // AC-3/Opus/AV1, disambiguated via the registration descriptor
+	STREAM_TYPE_ID3_METADATA   = 0x15
+	STREAM_TYPE_VIDEO_AV1_USER = 0x2000 // DVB/ATSC user-private range some encoders use for AV1
+)
+
+// Segment container formats handled by HlsClient.
+const (
+	ContainerUnknown = 0
+	ContainerTS      = 1
+	ContainerFMP4    = 2
 )
 
 var (
@@ -661,6 +1255,7 @@ var (
 	ErrInvaildPESHeader    = errors.New("invalid pes header")
 	ErrTryAgain            = errors.New("try again")
 	ErrNotLiveM3u8File     = errors.New("not live m3u8 file")
+	ErrInitSegmentFetch    = errors.New("failed to fetch init segment")
 )
 
 var (
@@ -683,11 +1278,21 @@ func (p *Prober) Do() (*StreamInfo, error) {
 		if ext == ".flv" {
 			client = &FlvClient{url: p.Url}
 		} else if ext == ".m3u8" {
-			client = &HlsClient{url: p.Url, scheme: u.Scheme, host: u.Host, lastSeqId: -1}
+			client = &HlsClient{url: p.Url, scheme: u.Scheme, host: u.Host, lastSeqId: -1, partsConsumedMsn: -1}
+		} else if ext == ".sdp" {
+			client = &WhepClient{url: p.Url}
 		} else {
 			return nil, ErrUnsupportedProtocol
 		}
 
+	case "rtmp", "rtmps":
+		client = &RtmpClient{url: p.Url}
+
+	case "whep":
+		whepUrl := *u
+		whepUrl.Scheme = "https"
+		client = &WhepClient{url: whepUrl.String()}
+
 	default:
 		return nil, ErrUnsupportedProtocol
 	}
@@ -719,7 +1324,11 @@ func (p *Prober) do(client Client) (*StreamInfo, error) {
 	}
 	defer client.Close()
 
-	player := NewPlayer(p.PlayerBufferTimeMs, info)
+	if p.Observer != nil {
+		p.Observer.OnConnect(info)
+	}
+
+	player := NewPlayer(p.PlayerBufferTimeMs, info, p.Observer, p.TickIntervalMs)
 	go player.Do()
 	defer player.Close()
 
@@ -748,23 +1357,197 @@ func (p *Prober) do(client Client) (*StreamInfo, error) {
 	return player.info, nil
 }
 
-func NewPlayer(playerBufferTimeMs uint32, info *StreamInfo) *Player {
+func NewPlayer(playerBufferTimeMs uint32, info *StreamInfo, observer Observer, tickIntervalMs uint32) *Player {
 	if playerBufferTimeMs > 30000 {
 		playerBufferTimeMs = 30000
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Player{
-		ctx:          ctx,
-		cancel:       cancel,
-		ch:           make(chan AVPacket, 256),
-		vqueue:       make([]AVPacket, 0, 256),
-		aqueue:       make([]AVPacket, 0, 256),
-		bufferTimeMs: time.Duration(playerBufferTimeMs),
-		info:         info,
+		ctx:            ctx,
+		cancel:         cancel,
+		ch:             make(chan AVPacket, 256),
+		vqueue:         make([]AVPacket, 0, 256),
+		aqueue:         make([]AVPacket, 0, 256),
+		bufferTimeMs:   time.Duration(playerBufferTimeMs),
+		info:           info,
+		fpsByTrack:     make(map[uint32]*trackFpsEstimator),
+		bitrateByTrack: make(map[uint32]*trackBitrateEstimator),
+		observer:       observer,
+		tickInterval:   time.Duration(tickIntervalMs) * time.Millisecond,
+	}
+}
+
+// trackFpsEstimator computes a rolling frame-rate estimate for one video
+// track, the same way the player's single-track estimate below does, but
+// keyed by TrackID so a multi-track source gets an independent number per
+// track in StreamInfo.Tracks.
+type trackFpsEstimator struct {
+	samples []uint32
+}
+
+const fpsEstimatorWindow = 60
+
+// observe records a video packet's pts and returns the estimated fps once
+// the window has filled, or 0 while still warming up.
+func (e *trackFpsEstimator) observe(pts uint32) float32 {
+	e.samples = append(e.samples, pts)
+	if len(e.samples) > fpsEstimatorWindow {
+		e.samples = e.samples[len(e.samples)-fpsEstimatorWindow:]
+	}
+	if len(e.samples) < fpsEstimatorWindow {
+		return 0
+	}
+
+	lastPts := int32(e.samples[0])
+	count := 0
+	totalDuration := int32(0)
+
+	for i := 1; i < len(e.samples); i++ {
+		pts := int32(e.samples[i])
+		if pts > lastPts && pts-lastPts < 100 {
+			totalDuration += pts - lastPts
+			count++
+		}
+		lastPts = pts
+	}
+
+	if totalDuration == 0 {
+		return 30
+	}
+
+	return float32(count) / float32(totalDuration) * 1000
+}
+
+// trackBitrateEstimator runs the same per-GOP running-average logic as
+// Player.observeBitrate, keyed by TrackID so a multi-track source gets an
+// independent TrackInfo.BitrateKbps per video track.
+type trackBitrateEstimator struct {
+	gopStart    time.Time
+	gopBytes    uint64
+	sampleCount uint32
+	meanKbps    float64
+}
+
+// observe folds the bytes of one packet into the current GOP and, on a new
+// keyframe, returns the updated running-average bitrate for the prior GOP
+// (0, false while still warming up or mid-GOP).
+func (e *trackBitrateEstimator) observe(pkt AVPacket) (uint32, bool) {
+	var kbps uint32
+	var ok bool
+
+	if pkt.keyframe {
+		if !e.gopStart.IsZero() && e.gopBytes != 0 {
+			if elapsedSec := time.Since(e.gopStart).Seconds(); elapsedSec > 0 {
+				sample := float64(e.gopBytes*8) / 1000 / elapsedSec
+				e.sampleCount++
+				e.meanKbps += (sample - e.meanKbps) / float64(e.sampleCount)
+				kbps, ok = uint32(e.meanKbps), true
+			}
+		}
+
+		e.gopStart = time.Now()
+		e.gopBytes = 0
+	}
+
+	e.gopBytes += uint64(pkt.size)
+	return kbps, ok
+}
+
+// setTrackBitrate writes a video track's estimated bitrate back into
+// info.Tracks.
+func (p *Player) setTrackBitrate(trackId uint32, kbps uint32) {
+	for i := range p.info.Tracks {
+		if p.info.Tracks[i].TrackID == trackId {
+			p.info.Tracks[i].BitrateKbps = kbps
+			return
+		}
+	}
+}
+
+// setTrackFps writes a video track's estimated fps back into info.Tracks.
+func (p *Player) setTrackFps(trackId uint32, fps float32) {
+	for i := range p.info.Tracks {
+		if p.info.Tracks[i].TrackID == trackId {
+			p.info.Tracks[i].Fps = fps
+			return
+		}
+	}
+}
+
+// endStall folds one finished steady-state stall into
+// StallDurationMsSteadyState and its histogram bucket.
+func (p *Player) endStall(since time.Time) {
+	d := time.Since(since)
+	p.info.StallDurationMsSteadyState += uint32(d.Milliseconds())
+	p.info.StallDurationHistogramMs[stallHistogramBucket(d)]++
+	log.Println("rebuffer cost time=", d)
+}
+
+// stallHistogramBucket classifies a stall duration into one of
+// StallDurationHistogramMs's 4 buckets: <1s, 1-3s, 3-10s, 10s+.
+func stallHistogramBucket(d time.Duration) int {
+	switch {
+	case d < time.Second:
+		return 0
+	case d < 3*time.Second:
+		return 1
+	case d < 10*time.Second:
+		return 2
+	default:
+		return 3
 	}
 }
 
+// computeMOS scores overall QoE (1.0-5.0) with a compact closed-form
+// combiner of startup delay, stall ratio and stall frequency, in the spirit
+// of the ITU-T P.1203 / Dash.js models: log-diminishing penalties for
+// startup delay and stall count (each additional stall or second of
+// startup delay costs less than the one before it), and a
+// linear penalty for the fraction of playback spent stalled.
+func computeMOS(startupDelayMs uint32, stallRatio float32, stallCount uint32) float32 {
+	const (
+		mosStartupWeight    = 0.6
+		mosStallRatioWeight = 3.0
+		mosStallCountWeight = 0.5
+	)
+
+	startupSec := float64(startupDelayMs) / 1000
+	mos := 5.0 -
+		mosStartupWeight*math.Log1p(startupSec) -
+		mosStallRatioWeight*float64(stallRatio) -
+		mosStallCountWeight*math.Log1p(float64(stallCount))
+
+	if mos < 1.0 {
+		mos = 1.0
+	} else if mos > 5.0 {
+		mos = 5.0
+	}
+
+	return float32(mos)
+}
+
+// observeBitrate accumulates encoded video bytes since the last keyframe
+// and, each time a new keyframe starts a GOP, folds the previous GOP's
+// byte count into a running average bitrate.
+func (p *Player) observeBitrate(pkt AVPacket) {
+	if pkt.keyframe {
+		if !p.gopStart.IsZero() && p.gopBytes != 0 {
+			if elapsedSec := time.Since(p.gopStart).Seconds(); elapsedSec > 0 {
+				kbps := float64(p.gopBytes*8) / 1000 / elapsedSec
+				p.bitrateSampleCount++
+				p.bitrateMeanKbps += (kbps - p.bitrateMeanKbps) / float64(p.bitrateSampleCount)
+				p.info.AvgVideoBitrateKbps = uint32(p.bitrateMeanKbps)
+			}
+		}
+
+		p.gopStart = time.Now()
+		p.gopBytes = 0
+	}
+
+	p.gopBytes += uint64(pkt.size)
+}
+
 func (p *Player) Do() {
 	var frameDuration time.Duration
 	var audioFrameDuration time.Duration
@@ -779,6 +1562,13 @@ func (p *Player) Do() {
 	ticker := time.NewTicker(30 * time.Millisecond)
 	defer ticker.Stop()
 
+	var obsTickerC <-chan time.Time
+	if p.observer != nil && p.tickInterval > 0 {
+		obsTicker := time.NewTicker(p.tickInterval)
+		defer obsTicker.Stop()
+		obsTickerC = obsTicker.C
+	}
+
 	for {
 		select {
 		case <-p.ctx.Done():
@@ -787,15 +1577,23 @@ func (p *Player) Do() {
 			}
 
 			if rebuffer {
-				p.info.TotalLagTimeMs += uint32(time.Since(lagTime).Milliseconds())
+				p.endStall(lagTime)
 			}
 
 			totalPlayTimeMs := float32(time.Since(startTime).Milliseconds())
-			p.info.LagRate = float32(p.info.TotalLagTimeMs) / totalPlayTimeMs
+			p.info.LagRate = float32(p.info.StallDurationMsSteadyState) / totalPlayTimeMs
+			p.info.MeanOpinionScore = computeMOS(p.info.StartupDelayMs, p.info.LagRate, p.info.StallCountSteadyState)
+
+			if p.observer != nil {
+				p.observer.OnEnd(p.info)
+			}
 
 			log.Println("player cycle end")
 			return
 
+		case <-obsTickerC:
+			p.observer.OnTick(p.info)
+
 		case pkt := <-p.ch:
 			if pkt.pktType == PktVideo {
 				log.Println("video pkt pts=", time.Duration(pkt.pts)*time.Millisecond, len(p.vqueue))
@@ -803,10 +1601,34 @@ func (p *Player) Do() {
 					hasVideo = true
 					p.info.FirstVideoPktTimeMs = uint32(time.Since(p.info.StartTime).Milliseconds())
 					log.Println("receive first video=", time.Since(p.info.StartTime))
+
+					if p.observer != nil {
+						p.observer.OnFirstVideo(p.info)
+					}
 				}
 
 				p.vqueue = append(p.vqueue, pkt)
 
+				est, ok := p.fpsByTrack[pkt.trackId]
+				if !ok {
+					est = &trackFpsEstimator{}
+					p.fpsByTrack[pkt.trackId] = est
+				}
+				if fps := est.observe(pkt.pts); fps != 0 {
+					p.setTrackFps(pkt.trackId, fps)
+				}
+
+				p.observeBitrate(pkt)
+
+				trackEst, ok := p.bitrateByTrack[pkt.trackId]
+				if !ok {
+					trackEst = &trackBitrateEstimator{}
+					p.bitrateByTrack[pkt.trackId] = trackEst
+				}
+				if kbps, ok := trackEst.observe(pkt); ok {
+					p.setTrackBitrate(pkt.trackId, kbps)
+				}
+
 				if !startPlay && len(p.vqueue) >= 60 {
 					// estimated frame rate
 					lastPts := int32(p.vqueue[0].pts)
@@ -834,6 +1656,7 @@ func (p *Player) Do() {
 					if bufferTime >= p.bufferTimeMs*time.Millisecond {
 						startPlay = true
 						startTime = time.Now()
+						p.info.StartupDelayMs = uint32(time.Since(p.info.StartTime).Milliseconds())
 						ticker.Reset(frameDuration)
 
 						if p.bufferTimeMs != 0 {
@@ -851,6 +1674,10 @@ func (p *Player) Do() {
 					hasAudio = true
 					p.info.FirstAudioPktTimeMs = uint32(time.Since(p.info.StartTime).Milliseconds())
 					log.Println("receive first audio=", time.Since(p.info.StartTime))
+
+					if p.observer != nil {
+						p.observer.OnFirstAudio(p.info)
+					}
 				}
 
 				p.aqueue = append(p.aqueue, pkt) //TODO:: support audio-only stream
@@ -876,8 +1703,11 @@ func (p *Player) Do() {
 			bufferTime := time.Duration(len(*queue)) * duratuon
 			if rebuffer && bufferTime >= p.bufferTimeMs*time.Millisecond {
 				rebuffer = false
-				p.info.TotalLagTimeMs += uint32(time.Since(lagTime).Milliseconds())
-				log.Println("rebuffer cost time=", time.Since(lagTime))
+				p.endStall(lagTime)
+
+				if p.observer != nil {
+					p.observer.OnResume(p.info)
+				}
 			}
 
 			if rebuffer {
@@ -889,8 +1719,12 @@ func (p *Player) Do() {
 			} else {
 				// play lag occurs
 				rebuffer = true
-				p.info.TotalLagCount++
+				p.info.StallCountSteadyState++
 				lagTime = time.Now()
+
+				if p.observer != nil {
+					p.observer.OnStall(p.info)
+				}
 			}
 		}
 	}
@@ -0,0 +1,65 @@
+package stream
+
+import "testing"
+
+// buildPMTSection assembles a minimal PMT section body (the part decodePMT
+// receives, i.e. data[0] is the table_id byte) with one stream row whose
+// esInfoLength is esInfoLength, followed by however many descriptor bytes
+// are supplied.
+func buildPMTSection(esInfoLength int, descriptorBytes int) []byte {
+	const programInfoLength = 0
+	// sectionLength only has to be large enough that the stream-loop for
+	// isn't what ends the loop early; actual termination below always
+	// comes from running out of row bytes (len(data) < 5).
+	const sectionLength = 1000
+
+	data := make([]byte, 12+programInfoLength)
+	data[1] = byte(sectionLength >> 8 & 0x0f)
+	data[2] = byte(sectionLength & 0xff)
+	data[10] = 0
+	data[11] = programInfoLength
+
+	row := make([]byte, 5+descriptorBytes)
+	row[0] = 0x1b // H.264 stream type
+	row[1] = 0x00
+	row[2] = 0x41 // elementary PID low byte
+	row[3] = byte(esInfoLength >> 8 & 0x0f)
+	row[4] = byte(esInfoLength & 0xff)
+
+	return append(data, row...)
+}
+
+func TestDecodePMTBoundsCheck(t *testing.T) {
+	tests := []struct {
+		name            string
+		esInfoLength    int
+		descriptorBytes int
+		wantStreams     int
+	}{
+		{
+			name:            "well-formed row is registered",
+			esInfoLength:    0,
+			descriptorBytes: 0,
+			wantStreams:     1,
+		},
+		{
+			name:            "esInfoLength claims more descriptor bytes than the section has",
+			esInfoLength:    200,
+			descriptorBytes: 0,
+			wantStreams:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &HlsClient{info: &StreamInfo{}}
+			data := buildPMTSection(tt.esInfoLength, tt.descriptorBytes)
+
+			c.decodePMT(data) // must not panic on the truncated case
+
+			if got := len(c.pmt.pmtStreams); got != tt.wantStreams {
+				t.Fatalf("len(pmt.pmtStreams) = %d, want %d", got, tt.wantStreams)
+			}
+		})
+	}
+}
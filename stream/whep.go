@@ -0,0 +1,245 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	mhttp "github.com/qiniu/httpping/http"
+)
+
+// whepConnectTimeout bounds how long Connect() waits for ICE/DTLS to finish
+// after the answer SDP has been applied, so a server that accepts the offer
+// but never actually connects doesn't hang the probe forever.
+const whepConnectTimeout = 10 * time.Second
+
+// WhepClient pulls whep:// (or https:// + Content-Type: application/sdp)
+// streams: POST an SDP offer per the WHEP spec, negotiate ICE/DTLS/SRTP via
+// pion/webrtc, then demux the resulting RTP streams into AVPackets the same
+// way FlvClient demuxes its tag stream.
+type WhepClient struct {
+	url     string
+	header  map[string]string
+	timeout time.Duration
+
+	pc      *webrtc.PeerConnection
+	info    *StreamInfo
+	packets chan AVPacket
+
+	firstRtpOnce sync.Once
+	statsCtx     context.Context
+	statsCancel  context.CancelFunc
+}
+
+func (c *WhepClient) Connect() (*StreamInfo, error) {
+	info := &StreamInfo{StartTime: time.Now()}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return info, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return info, err
+	}
+	c.pc = pc
+	c.packets = make(chan AVPacket, 256)
+
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return info, err
+	}
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return info, err
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go c.readTrack(track)
+	})
+
+	connected := make(chan struct{})
+	var connectOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			connectOnce.Do(func() { close(connected) })
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return info, err
+	}
+
+	gatherStart := time.Now()
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return info, err
+	}
+	<-gatherComplete
+	info.IceGatheringTimeMs = uint32(time.Since(gatherStart).Milliseconds())
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader([]byte(pc.LocalDescription().SDP)))
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+
+	tcp := &mhttp.TcpWrapper{}
+	hc := &http.Client{
+		Transport: &http.Transport{DialContext: tcp.Dial, DialTLSContext: tcp.DialTLS},
+		Timeout:   c.timeout,
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		info.ErrCode = ErrTcpConnectTimeout
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	info.init(tcp, resp)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		info.ErrCode = ErrInvalidHttpCode
+		return info, nil
+	}
+
+	answerSdp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return info, err
+	}
+
+	c.info = info
+	c.statsCtx, c.statsCancel = context.WithCancel(context.Background())
+
+	dtlsStart := time.Now()
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answerSdp)}); err != nil {
+		return info, err
+	}
+
+	select {
+	case <-connected:
+		info.DtlsHandshakeTimeMs = uint32(time.Since(dtlsStart).Milliseconds())
+	case <-time.After(whepConnectTimeout):
+	}
+
+	go c.pollStats()
+
+	return info, nil
+}
+
+// readTrack demuxes one inbound RTP stream into AVPackets, mirroring the
+// per-track handling FlvClient/HlsClient do for their own media. RTP carries
+// no container-level keyframe marker generically, so keyframe is left false
+// here just like FlvClient leaves it for non-key FLV tags.
+func (c *WhepClient) readTrack(track *webrtc.TrackRemote) {
+	pktType := uint32(PktAudio)
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		pktType = PktVideo
+	}
+
+	trackId := uint32(track.SSRC())
+	if c.info != nil {
+		c.info.addTrack(TrackInfo{TrackID: trackId, Type: pktType, Codec: strings.ToLower(track.Codec().MimeType)})
+	}
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		c.firstRtpOnce.Do(func() {
+			if c.info != nil {
+				c.info.FirstRtpPktTimeMs = uint32(time.Since(c.info.StartTime).Milliseconds())
+			}
+		})
+
+		select {
+		case c.packets <- AVPacket{pktType: pktType, pts: pkt.Timestamp, trackId: trackId}:
+		case <-c.statsCtx.Done():
+			return
+		}
+	}
+}
+
+func (c *WhepClient) Read() (*AVPacket, error) {
+	select {
+	case pkt, ok := <-c.packets:
+		if !ok {
+			return nil, ErrTryAgain
+		}
+		return &pkt, nil
+	case <-time.After(200 * time.Millisecond):
+		return nil, ErrTryAgain
+	}
+}
+
+func (c *WhepClient) Close() {
+	if c.statsCancel != nil {
+		c.statsCancel()
+	}
+	if c.pc != nil {
+		c.pc.Close()
+	}
+}
+
+// pollStats periodically drains pc.GetStats() for the RTCP-derived quality
+// counters that have no per-packet equivalent: jitter, packet loss and
+// NACK/PLI counts only surface through WebRTC's stats API.
+func (c *WhepClient) pollStats() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.statsCtx.Done():
+			return
+		case <-ticker.C:
+			c.updateStats()
+		}
+	}
+}
+
+func (c *WhepClient) updateStats() {
+	var jitterSum float64
+	var lostSum, receivedSum int64
+	var nackSum, pliSum uint32
+	var streamCount int
+
+	for _, s := range c.pc.GetStats() {
+		in, ok := s.(webrtc.InboundRTPStreamStats)
+		if !ok {
+			continue
+		}
+
+		jitterSum += in.Jitter
+		lostSum += int64(in.PacketsLost)
+		receivedSum += int64(in.PacketsReceived)
+		nackSum += in.NACKCount
+		pliSum += in.PLICount
+		streamCount++
+	}
+
+	if streamCount == 0 {
+		return
+	}
+
+	c.info.JitterMs = float32(jitterSum / float64(streamCount) * 1000)
+	c.info.NackCount = nackSum
+	c.info.PliCount = pliSum
+
+	if total := lostSum + receivedSum; total > 0 {
+		c.info.PacketLossRate = float32(lostSum) / float32(total)
+	}
+}